@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// backupPolicy says what is kept of a file's previous content when it is
+// saved.
+type backupPolicy struct {
+	mode string // "off", "simple", "numbered" or "dir"
+	dir  string // where "dir" keeps backups
+	keep int    // numbered backups to keep; 0 keeps them all
+}
+
+func parseBackupMode(s string) (string, error) {
+	switch s {
+	case "off", "simple", "numbered", "dir":
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown backup mode %q (want off, simple, numbered or dir)", s)
+}
+
+// backup copies the file at path, as it is before being saved, according
+// to the policy. The copy gets the original's permissions, and replaces
+// rather than follows a symlink that has the backup's name. Numbered
+// backups beyond those to keep are deleted only once the new one is
+// written.
+func (p backupPolicy) backup(path string) error {
+	if p.mode == "off" {
+		return nil
+	}
+	target, err := resolveLinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // nothing to back up yet
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	name := target + ".bak"
+	var old []string
+	if p.mode == "numbered" || p.mode == "dir" {
+		base := target
+		if p.mode == "dir" {
+			if err := os.MkdirAll(p.dir, 0700); err != nil {
+				return err
+			}
+			abs, err := filepath.Abs(target)
+			if err != nil {
+				return err
+			}
+			// The whole path goes into the name, so that files with the
+			// same name in different directories do not collide.
+			base = filepath.Join(p.dir, strings.ReplaceAll(abs, string(filepath.Separator), "%"))
+		}
+		versions, err := backupVersions(base)
+		if err != nil {
+			return err
+		}
+		next := 1
+		if len(versions) > 0 {
+			next = versions[len(versions)-1] + 1
+		}
+		name = numberedBackup(base, next)
+		if p.keep > 0 && len(versions) >= p.keep {
+			for _, v := range versions[:len(versions)-p.keep+1] {
+				old = append(old, numberedBackup(base, v))
+			}
+		}
+	}
+	if err := replaceFile(name, data, info, target); err != nil {
+		return err
+	}
+	for _, name := range old {
+		os.Remove(name)
+	}
+	return nil
+}
+
+// numberedBackup returns the name of version n of the backups of base, in
+// the form base.~n~ used by Emacs and GNU cp.
+func numberedBackup(base string, n int) string {
+	return base + ".~" + strconv.Itoa(n) + "~"
+}
+
+// backupVersions returns the numbers of the existing backups of base in
+// ascending order.
+func backupVersions(base string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Dir(base))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(base) + ".~"
+	var versions []int
+	for _, e := range entries {
+		s, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		s, ok = strings.CutSuffix(s, "~")
+		if n, err := strconv.Atoi(s); ok && err == nil && n > 0 {
+			versions = append(versions, n)
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
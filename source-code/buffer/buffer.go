@@ -0,0 +1,356 @@
+// Package buffer holds the text of a file being edited.
+//
+// The text is stored in a rope: a binary tree whose leaves are short
+// strings and whose inner nodes cache the byte length and newline count of
+// their subtree. Inserting, deleting and looking up a line are O(log n), so
+// editing a multi-hundred-megabyte log costs the same as editing a small
+// source file. Nodes are never modified once built; an edit copies the path
+// from the root to the changed leaf, which also makes Snapshot free.
+package buffer
+
+import (
+	"io"
+	"strings"
+)
+
+const (
+	// leafSize is the size of the leaves built when loading text.
+	leafSize = 1024
+	// maxLeaf is the size above which an edited leaf is split.
+	maxLeaf = 2 * leafSize
+)
+
+type node struct {
+	left, right *node
+	text        string // leaves only
+	length      int    // bytes in the subtree
+	lines       int    // '\n' bytes in the subtree
+	leaves      int
+	height      int
+}
+
+func (n *node) isLeaf() bool {
+	return n.left == nil && n.right == nil
+}
+
+func newLeaf(s string) *node {
+	return &node{text: s, length: len(s), lines: strings.Count(s, "\n"), leaves: 1}
+}
+
+func concat(l, r *node) *node {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	return &node{
+		left:   l,
+		right:  r,
+		length: l.length + r.length,
+		lines:  l.lines + r.lines,
+		leaves: l.leaves + r.leaves,
+		height: max(l.height, r.height) + 1,
+	}
+}
+
+// build returns a balanced tree over the given leaves.
+func build(leaves []*node) *node {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return leaves[0]
+	}
+	mid := len(leaves) / 2
+	return concat(build(leaves[:mid]), build(leaves[mid:]))
+}
+
+// chunk splits s into leaves of at most leafSize bytes.
+func chunk(s string) []*node {
+	leaves := make([]*node, 0, len(s)/leafSize+1)
+	for len(s) > leafSize {
+		leaves = append(leaves, newLeaf(s[:leafSize]))
+		s = s[leafSize:]
+	}
+	if s != "" {
+		leaves = append(leaves, newLeaf(s))
+	}
+	return leaves
+}
+
+func insert(n *node, off int, s string) *node {
+	if n == nil {
+		return build(chunk(s))
+	}
+	if n.isLeaf() {
+		text := n.text[:off] + s + n.text[off:]
+		if len(text) <= maxLeaf {
+			return newLeaf(text)
+		}
+		return build(chunk(text))
+	}
+	if off <= n.left.length {
+		return concat(insert(n.left, off, s), n.right)
+	}
+	return concat(n.left, insert(n.right, off-n.left.length, s))
+}
+
+// remove deletes the bytes [start, end) of n, which must overlap it.
+func remove(n *node, start, end int) *node {
+	if start <= 0 && end >= n.length {
+		return nil
+	}
+	if n.isLeaf() {
+		return newLeaf(n.text[:max(start, 0)] + n.text[min(end, n.length):])
+	}
+	l, r := n.left, n.right
+	if start < l.length {
+		l = remove(l, start, min(end, l.length))
+	}
+	if end > n.left.length {
+		r = remove(r, start-n.left.length, end-n.left.length)
+	}
+	return concat(l, r)
+}
+
+// collect appends the non-empty leaves of n to leaves, merging neighbours
+// that are small enough to share a leaf.
+func collect(n *node, leaves []*node) []*node {
+	if n == nil {
+		return leaves
+	}
+	if !n.isLeaf() {
+		return collect(n.right, collect(n.left, leaves))
+	}
+	if n.length == 0 {
+		return leaves
+	}
+	if k := len(leaves) - 1; k >= 0 && leaves[k].length+n.length <= leafSize {
+		leaves[k] = newLeaf(leaves[k].text + n.text)
+		return leaves
+	}
+	return append(leaves, n)
+}
+
+// balanced reports whether n is shallow enough for its number of leaves.
+func balanced(n *node) bool {
+	limit := 8
+	for l := n.leaves; l > 0; l >>= 1 {
+		limit += 2
+	}
+	return n.height <= limit
+}
+
+// Buffer is an editable piece of text. The zero value is an empty buffer.
+type Buffer struct {
+	root *node
+}
+
+// New returns a buffer holding s.
+func New(s string) *Buffer {
+	return &Buffer{root: build(chunk(s))}
+}
+
+// Snapshot returns an independent copy of b. It does not copy the text.
+func (b *Buffer) Snapshot() *Buffer {
+	return &Buffer{root: b.root}
+}
+
+// Len returns the length of the text in bytes.
+func (b *Buffer) Len() int {
+	if b.root == nil {
+		return 0
+	}
+	return b.root.length
+}
+
+// LineCount returns the number of lines. Text that ends in a newline has an
+// empty last line, so an empty buffer has one line.
+func (b *Buffer) LineCount() int {
+	if b.root == nil {
+		return 1
+	}
+	return b.root.lines + 1
+}
+
+func (b *Buffer) clamp(off int) int {
+	return max(0, min(off, b.Len()))
+}
+
+// Insert inserts s at byte offset off.
+func (b *Buffer) Insert(off int, s string) {
+	if s == "" {
+		return
+	}
+	b.root = insert(b.root, b.clamp(off), s)
+	b.rebalance()
+}
+
+// Delete removes n bytes starting at byte offset off and returns them.
+func (b *Buffer) Delete(off, n int) string {
+	start, end := b.clamp(off), b.clamp(off+n)
+	if start >= end {
+		return ""
+	}
+	deleted := b.Slice(start, end)
+	b.root = remove(b.root, start, end)
+	b.rebalance()
+	return deleted
+}
+
+func (b *Buffer) rebalance() {
+	if b.root != nil && !balanced(b.root) {
+		b.root = build(collect(b.root, nil))
+	}
+}
+
+// Slice returns the bytes [start, end) of the text.
+func (b *Buffer) Slice(start, end int) string {
+	start, end = b.clamp(start), b.clamp(end)
+	if start >= end {
+		return ""
+	}
+	var sb strings.Builder
+	sb.Grow(end - start)
+	b.walk(start, end, func(s string) bool {
+		sb.WriteString(s)
+		return true
+	})
+	return sb.String()
+}
+
+// walk calls fn with consecutive pieces of the bytes [start, end) until fn
+// returns false.
+func (b *Buffer) walk(start, end int, fn func(string) bool) {
+	var visit func(n *node, start, end int) bool
+	visit = func(n *node, start, end int) bool {
+		if n == nil || start >= end {
+			return true
+		}
+		if n.isLeaf() {
+			return fn(n.text[max(start, 0):min(end, n.length)])
+		}
+		if start < n.left.length && !visit(n.left, start, min(end, n.left.length)) {
+			return false
+		}
+		if end > n.left.length {
+			return visit(n.right, start-n.left.length, end-n.left.length)
+		}
+		return true
+	}
+	visit(b.root, start, end)
+}
+
+// String returns the whole text.
+func (b *Buffer) String() string {
+	return b.Slice(0, b.Len())
+}
+
+// Equal reports whether the text is s, without building it as one string.
+func (b *Buffer) Equal(s string) bool {
+	if b.Len() != len(s) {
+		return false
+	}
+	off, equal := 0, true
+	b.walk(0, b.Len(), func(piece string) bool {
+		equal = s[off:off+len(piece)] == piece
+		off += len(piece)
+		return equal
+	})
+	return equal
+}
+
+// WriteTo writes the text to w without building it as one string.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	var err error
+	b.walk(0, b.Len(), func(s string) bool {
+		var n int
+		n, err = io.WriteString(w, s)
+		total += int64(n)
+		return err == nil
+	})
+	return total, err
+}
+
+// LineStart returns the byte offset of the first byte of line i. Lines are
+// counted from zero and i is clamped to the valid range.
+func (b *Buffer) LineStart(i int) int {
+	if i <= 0 || b.root == nil {
+		return 0
+	}
+	if i > b.root.lines {
+		i = b.root.lines
+	}
+	off := 0
+	n := b.root
+	for !n.isLeaf() {
+		if n.left.lines >= i {
+			n = n.left
+		} else {
+			i -= n.left.lines
+			off += n.left.length
+			n = n.right
+		}
+	}
+	idx := 0
+	for ; i > 0; i-- {
+		idx += strings.IndexByte(n.text[idx:], '\n') + 1
+	}
+	return off + idx
+}
+
+// LineEnd returns the byte offset of the newline ending line i, or Len for
+// the last line.
+func (b *Buffer) LineEnd(i int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= b.LineCount()-1 {
+		return b.Len()
+	}
+	return b.LineStart(i+1) - 1
+}
+
+// Line returns line i without its newline.
+func (b *Buffer) Line(i int) string {
+	return b.Slice(b.LineStart(i), b.LineEnd(i))
+}
+
+// LineLen returns the length of line i in bytes, without its newline.
+func (b *Buffer) LineLen(i int) int {
+	return b.LineEnd(i) - b.LineStart(i)
+}
+
+// Offset converts a line and a byte column to a byte offset. The column is
+// clamped to the line.
+func (b *Buffer) Offset(line, col int) int {
+	start := b.LineStart(line)
+	return start + max(0, min(col, b.LineEnd(line)-start))
+}
+
+// Position converts a byte offset to a line and a byte column.
+func (b *Buffer) Position(off int) (line, col int) {
+	off = b.clamp(off)
+	line = b.newlinesBefore(off)
+	return line, off - b.LineStart(line)
+}
+
+func (b *Buffer) newlinesBefore(off int) int {
+	count := 0
+	n := b.root
+	if n == nil {
+		return 0
+	}
+	for !n.isLeaf() {
+		if off < n.left.length {
+			n = n.left
+		} else {
+			count += n.left.lines
+			off -= n.left.length
+			n = n.right
+		}
+	}
+	return count + strings.Count(n.text[:off], "\n")
+}
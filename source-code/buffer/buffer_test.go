@@ -0,0 +1,254 @@
+package buffer
+
+import (
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// check compares b with want, the same text kept as a plain string, and
+// checks the invariants of the tree.
+func check(t *testing.T, b *Buffer, want string) {
+	t.Helper()
+	if got := b.String(); got != want {
+		t.Fatalf("text = %q, want %q", got, want)
+	}
+	if b.Len() != len(want) {
+		t.Fatalf("Len = %d, want %d", b.Len(), len(want))
+	}
+	if n := strings.Count(want, "\n") + 1; b.LineCount() != n {
+		t.Fatalf("LineCount = %d, want %d", b.LineCount(), n)
+	}
+	if b.root != nil {
+		if !balanced(b.root) {
+			t.Fatalf("unbalanced: height %d with %d leaves", b.root.height, b.root.leaves)
+		}
+		checkNode(t, b.root)
+	}
+}
+
+func checkNode(t *testing.T, n *node) {
+	t.Helper()
+	if n.isLeaf() {
+		if n.length != len(n.text) || n.lines != strings.Count(n.text, "\n") || n.leaves != 1 || n.height != 0 {
+			t.Fatalf("bad leaf %+v", n)
+		}
+		return
+	}
+	checkNode(t, n.left)
+	checkNode(t, n.right)
+	if n.length != n.left.length+n.right.length || n.lines != n.left.lines+n.right.lines ||
+		n.leaves != n.left.leaves+n.right.leaves || n.height != max(n.left.height, n.right.height)+1 {
+		t.Fatalf("bad inner node: length %d lines %d leaves %d height %d", n.length, n.lines, n.leaves, n.height)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, s := range []string{"", "a", "a\nb\n", strings.Repeat("x", leafSize), strings.Repeat("line\n", 1000)} {
+		check(t, New(s), s)
+	}
+	var zero Buffer
+	check(t, &zero, "")
+}
+
+func TestInsertDelete(t *testing.T) {
+	b := New("hello world")
+	b.Insert(5, ",")
+	check(t, b, "hello, world")
+	b.Insert(0, ">> ")
+	check(t, b, ">> hello, world")
+	b.Insert(b.Len(), "\n")
+	check(t, b, ">> hello, world\n")
+	b.Insert(-5, "a")
+	check(t, b, "a>> hello, world\n")
+	b.Insert(1000, "z")
+	check(t, b, "a>> hello, world\nz")
+	if got := b.Delete(1, 3); got != ">> " {
+		t.Fatalf("Delete returned %q", got)
+	}
+	check(t, b, "ahello, world\nz")
+	if got := b.Delete(10, 100); got != "rld\nz" {
+		t.Fatalf("Delete returned %q", got)
+	}
+	check(t, b, "ahello, wo")
+	if got := b.Delete(3, 0); got != "" {
+		t.Fatalf("Delete returned %q", got)
+	}
+	b.Delete(0, b.Len())
+	check(t, b, "")
+}
+
+func TestSlice(t *testing.T) {
+	s := strings.Repeat("0123456789", 500)
+	b := New(s)
+	for _, c := range []struct{ start, end int }{
+		{0, 0}, {0, 10}, {leafSize - 3, leafSize + 3}, {100, 4000}, {4990, 5000}, {-10, 5}, {4995, 6000}, {20, 10},
+	} {
+		start, end := max(0, min(c.start, len(s))), max(0, min(c.end, len(s)))
+		want := ""
+		if start < end {
+			want = s[start:end]
+		}
+		if got := b.Slice(c.start, c.end); got != want {
+			t.Errorf("Slice(%d, %d) = %q, want %q", c.start, c.end, got, want)
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	s := strings.Repeat("abc\n", 2000)
+	var sb strings.Builder
+	n, err := New(s).WriteTo(&sb)
+	if err != nil || n != int64(len(s)) || sb.String() != s {
+		t.Fatalf("WriteTo = %d, %v", n, err)
+	}
+}
+
+// TestRandomEdits applies random edits, many of them across leaf
+// boundaries, to a buffer and to a string, and compares the two.
+func TestRandomEdits(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	want := strings.Repeat("abcdefg\n", 3*leafSize/8)
+	b := New(want)
+	for i := 0; i < 3000; i++ {
+		off := r.IntN(len(want) + 1)
+		if i%3 == 0 {
+			// Near a boundary of the leaves as loaded.
+			off = min(len(want), (off/leafSize)*leafSize+r.IntN(3)-1)
+			off = max(0, off)
+		}
+		if r.IntN(2) == 0 || len(want) == 0 {
+			s := randomText(r, r.IntN(3*leafSize))
+			if r.IntN(4) != 0 {
+				s = s[:min(len(s), 5)]
+			}
+			b.Insert(off, s)
+			want = want[:off] + s + want[off:]
+		} else {
+			n := r.IntN(min(len(want)-off, 2*leafSize) + 1)
+			if got := b.Delete(off, n); got != want[off:off+n] {
+				t.Fatalf("Delete(%d, %d) = %q, want %q", off, n, got, want[off:off+n])
+			}
+			want = want[:off] + want[off+n:]
+		}
+		if i%100 == 0 {
+			check(t, b, want)
+		}
+		start := r.IntN(len(want) + 1)
+		end := start + r.IntN(len(want)-start+1)
+		if got := b.Slice(start, end); got != want[start:end] {
+			t.Fatalf("Slice(%d, %d) = %q, want %q", start, end, got, want[start:end])
+		}
+	}
+	check(t, b, want)
+}
+
+// TestRebalance builds a degenerate tree by always inserting at the end and
+// checks that it is kept shallow.
+func TestRebalance(t *testing.T) {
+	var b Buffer
+	var sb strings.Builder
+	for i := 0; i < 5000; i++ {
+		s := strings.Repeat("y", maxLeaf+1)
+		b.Insert(b.Len(), s)
+		sb.WriteString(s)
+	}
+	check(t, &b, sb.String())
+	for i := 0; i < 4000; i++ {
+		b.Delete(0, maxLeaf/2)
+	}
+	check(t, &b, sb.String()[4000*(maxLeaf/2):])
+}
+
+func TestEqual(t *testing.T) {
+	s := strings.Repeat("0123456789", 500)
+	b := New(s)
+	if !b.Equal(s) {
+		t.Fatal("Equal is false for the same text")
+	}
+	for _, other := range []string{"", s[1:], s + "x", s[:leafSize] + "X" + s[leafSize+1:]} {
+		if b.Equal(other) {
+			t.Fatalf("Equal is true for text of length %d", len(other))
+		}
+	}
+	if !New("").Equal("") {
+		t.Fatal("an empty buffer is not equal to the empty string")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	b := New("one\ntwo\n")
+	s := b.Snapshot()
+	b.Insert(0, "zero\n")
+	b.Delete(b.Len()-4, 4)
+	check(t, s, "one\ntwo\n")
+	check(t, b, "zero\none\n")
+}
+
+func TestLines(t *testing.T) {
+	for _, s := range []string{"", "\n", "a", "a\n", "a\nbb\n\nccc", "a\nbb\n\nccc\n\n", strings.Repeat("x\n", 3000)} {
+		b := New(s)
+		lines := strings.Split(s, "\n")
+		if b.LineCount() != len(lines) {
+			t.Fatalf("%q: LineCount = %d, want %d", s, b.LineCount(), len(lines))
+		}
+		off := 0
+		for i, line := range lines {
+			if got := b.LineStart(i); got != off {
+				t.Fatalf("%q: LineStart(%d) = %d, want %d", s, i, got, off)
+			}
+			if got := b.LineEnd(i); got != off+len(line) {
+				t.Fatalf("%q: LineEnd(%d) = %d, want %d", s, i, got, off+len(line))
+			}
+			if got := b.Line(i); got != line {
+				t.Fatalf("%q: Line(%d) = %q, want %q", s, i, got, line)
+			}
+			if got := b.LineLen(i); got != len(line) {
+				t.Fatalf("%q: LineLen(%d) = %d, want %d", s, i, got, len(line))
+			}
+			off += len(line) + 1
+		}
+		last := len(lines) - 1
+		if b.LineStart(-1) != 0 || b.LineStart(last+5) != b.LineStart(last) || b.LineEnd(last+5) != len(s) || b.LineEnd(-1) != 0 {
+			t.Fatalf("%q: out-of-range lines are not clamped", s)
+		}
+	}
+}
+
+func TestPositionOffset(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	s := randomText(r, 5*leafSize)
+	b := New(s)
+	for off := 0; off <= len(s); off++ {
+		line, col := b.Position(off)
+		want := strings.Count(s[:off], "\n")
+		if line != want || col != off-(strings.LastIndexByte(s[:off], '\n')+1) {
+			t.Fatalf("Position(%d) = %d, %d", off, line, col)
+		}
+		if got := b.Offset(line, col); got != off {
+			t.Fatalf("Offset(Position(%d)) = %d", off, got)
+		}
+	}
+	if line, col := b.Position(-3); line != 0 || col != 0 {
+		t.Fatalf("Position(-3) = %d, %d", line, col)
+	}
+	if line, _ := b.Position(len(s) + 3); line != b.LineCount()-1 {
+		t.Fatalf("Position past the end is on line %d", line)
+	}
+	if got := b.Offset(1, 1000); got != b.LineEnd(1) {
+		t.Fatalf("Offset(1, 1000) = %d, want the end of line 1, %d", got, b.LineEnd(1))
+	}
+	if got := b.Offset(0, -1); got != 0 {
+		t.Fatalf("Offset(0, -1) = %d", got)
+	}
+}
+
+// randomText returns n bytes of short lines of letters.
+func randomText(r *rand.Rand, n int) string {
+	const chars = "abcdefghij      \n"
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteByte(chars[r.IntN(len(chars))])
+	}
+	return sb.String()
+}
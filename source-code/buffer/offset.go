@@ -0,0 +1,117 @@
+package buffer
+
+import (
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// The functions below convert between the three ways of addressing a column
+// within one line: a byte index, a rune index and a visual column, which
+// accounts for tab stops and wide characters.
+
+// InvalidWidth is the number of cells taken by the placeholder, such as
+// <FF>, shown for a byte that is not valid UTF-8.
+const InvalidWidth = 4
+
+// ControlWidth is the number of cells taken by a control character other
+// than tab, which is shown in caret notation, such as ^M for a stray "\r".
+const ControlWidth = 2
+
+// IsControl reports whether r is a control character shown in caret
+// notation.
+func IsControl(r rune) bool {
+	return (r < 0x20 && r != '\t') || r == 0x7F
+}
+
+// Caret returns the caret notation of the control character r.
+func Caret(r rune) string {
+	return "^" + string(r^0x40)
+}
+
+// VisualWidth returns the number of cells r occupies when it starts at
+// visual column col.
+func VisualWidth(r rune, col, tabWidth int) int {
+	if r == '\t' {
+		return tabWidth - (col % tabWidth)
+	}
+	if IsControl(r) {
+		return ControlWidth
+	}
+	return runewidth.RuneWidth(r)
+}
+
+// CharWidth is VisualWidth for a character as decoded from the text with
+// its size, so that an invalid byte, decoded as utf8.RuneError of size 1,
+// gets the width of its placeholder.
+func CharWidth(r rune, size, col, tabWidth int) int {
+	if r == utf8.RuneError && size == 1 {
+		return InvalidWidth
+	}
+	return VisualWidth(r, col, tabWidth)
+}
+
+// VisualCol returns the visual column of byte index bytePos in line.
+func VisualCol(line string, bytePos, tabWidth int) int {
+	col := 0
+	j := 0
+	for j < bytePos && j < len(line) {
+		r, size := utf8.DecodeRuneInString(line[j:])
+		col += CharWidth(r, size, col, tabWidth)
+		j += size
+	}
+	return col
+}
+
+// ByteFromVisual returns the byte index of the character covering visual
+// column target, or len(line) if the line is shorter.
+func ByteFromVisual(line string, target, tabWidth int) int {
+	col := 0
+	j := 0
+	for j < len(line) {
+		r, size := utf8.DecodeRuneInString(line[j:])
+		w := CharWidth(r, size, col, tabWidth)
+		if col+w > target {
+			break
+		}
+		col += w
+		j += size
+	}
+	return j
+}
+
+// RuneCol returns the rune index of byte index bytePos in line.
+func RuneCol(line string, bytePos int) int {
+	return utf8.RuneCountInString(line[:min(bytePos, len(line))])
+}
+
+// ByteFromRune returns the byte index of rune index runeCol in line, or
+// len(line) if the line is shorter.
+func ByteFromRune(line string, runeCol int) int {
+	j := 0
+	for ; runeCol > 0 && j < len(line); runeCol-- {
+		_, size := utf8.DecodeRuneInString(line[j:])
+		j += size
+	}
+	return j
+}
+
+// PrevRune returns the byte index of the rune before pos. Each byte that
+// is not part of a valid UTF-8 sequence counts as a rune of its own.
+func PrevRune(line string, pos int) int {
+	if pos <= 0 {
+		return 0
+	}
+	_, size := utf8.DecodeLastRuneInString(line[:min(pos, len(line))])
+	return min(pos, len(line)) - size
+}
+
+// NextRune returns the byte index of the rune after pos, stepping over an
+// invalid byte on its own.
+func NextRune(line string, pos int) int {
+	if pos >= len(line) {
+		return len(line)
+	}
+	_, size := utf8.DecodeRuneInString(line[pos:])
+	return pos + size
+}
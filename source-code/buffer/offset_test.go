@@ -0,0 +1,127 @@
+package buffer
+
+import (
+	"testing"
+)
+
+func TestVisualCol(t *testing.T) {
+	for _, c := range []struct {
+		line    string
+		bytePos int
+		want    int
+	}{
+		{"abc", 0, 0},
+		{"abc", 2, 2},
+		{"abc", 10, 3},
+		{"\tx", 1, 4},
+		{"ab\tx", 3, 4},
+		{"abcd\tx", 5, 8},
+		{"a\t\tx", 3, 8},
+		{"żółw", 2, 1},
+		{"żółw", len("żółw"), 4},
+		{"日本", 3, 2},
+		{"日本x", 6, 4},
+		{"a\xffb", 2, 1 + InvalidWidth},
+		{"\xff\tx", 2, 8},
+		{"a\rb", 2, 1 + ControlWidth},
+		{"\x1b\tx", 2, 4},
+		{"\x7f", 1, ControlWidth},
+	} {
+		if got := VisualCol(c.line, c.bytePos, 4); got != c.want {
+			t.Errorf("VisualCol(%q, %d) = %d, want %d", c.line, c.bytePos, got, c.want)
+		}
+	}
+}
+
+func TestByteFromVisual(t *testing.T) {
+	for _, c := range []struct {
+		line   string
+		target int
+		want   int
+	}{
+		{"abc", 0, 0},
+		{"abc", 2, 2},
+		{"abc", 9, 3},
+		{"\tx", 2, 0}, // inside the tab
+		{"\tx", 4, 1},
+		{"日本", 1, 0}, // the right half of a wide character
+		{"日本", 2, 3},
+		{"a\xffb", 3, 1}, // inside the placeholder
+		{"a\xffb", 5, 2},
+	} {
+		if got := ByteFromVisual(c.line, c.target, 4); got != c.want {
+			t.Errorf("ByteFromVisual(%q, %d) = %d, want %d", c.line, c.target, got, c.want)
+		}
+	}
+	// Every character start survives the round trip.
+	for _, line := range []string{"a\tb\tc", "żó\tłw", "日\t本\xfe\xffx"} {
+		for j := 0; j <= len(line); j = NextRune(line, j) {
+			if got := ByteFromVisual(line, VisualCol(line, j, 4), 4); got != j {
+				t.Errorf("%q: ByteFromVisual(VisualCol(%d)) = %d", line, j, got)
+			}
+			if j == len(line) {
+				break
+			}
+		}
+	}
+}
+
+func TestRuneCol(t *testing.T) {
+	line := "aż\xffb日"
+	cols := []int{0, 1, 3, 4, 5, 8}
+	for i, j := range cols {
+		if got := RuneCol(line, j); got != i {
+			t.Errorf("RuneCol(%q, %d) = %d, want %d", line, j, got, i)
+		}
+		if got := ByteFromRune(line, i); got != j {
+			t.Errorf("ByteFromRune(%q, %d) = %d, want %d", line, i, got, j)
+		}
+	}
+	if got := RuneCol(line, 100); got != len(cols)-1 {
+		t.Errorf("RuneCol past the end = %d", got)
+	}
+	if got := ByteFromRune(line, 100); got != len(line) {
+		t.Errorf("ByteFromRune past the end = %d", got)
+	}
+}
+
+func TestPrevNextRune(t *testing.T) {
+	line := "aż\xff\xfe日"
+	starts := []int{0, 1, 3, 4, 5, 8}
+	for i := 1; i < len(starts); i++ {
+		if got := NextRune(line, starts[i-1]); got != starts[i] {
+			t.Errorf("NextRune(%d) = %d, want %d", starts[i-1], got, starts[i])
+		}
+		if got := PrevRune(line, starts[i]); got != starts[i-1] {
+			t.Errorf("PrevRune(%d) = %d, want %d", starts[i], got, starts[i-1])
+		}
+	}
+	if PrevRune(line, 0) != 0 || NextRune(line, len(line)) != len(line) || PrevRune(line, 100) != 5 {
+		t.Error("PrevRune and NextRune do not stop at the ends of the line")
+	}
+}
+
+func TestCaret(t *testing.T) {
+	for r, want := range map[rune]string{'\r': "^M", 0: "^@", 0x1b: "^[", 0x7f: "^?"} {
+		if !IsControl(r) || Caret(r) != want {
+			t.Errorf("Caret(%q) = %q, want %q", r, Caret(r), want)
+		}
+	}
+	for _, r := range []rune{'\t', 'a', ' ', 'ż'} {
+		if IsControl(r) {
+			t.Errorf("IsControl(%q) is true", r)
+		}
+	}
+}
+
+func TestCharWidth(t *testing.T) {
+	if got := CharWidth('�', 3, 0, 4); got != 1 {
+		t.Errorf("a real U+FFFD is %d wide", got)
+	}
+	if got := CharWidth('�', 1, 0, 4); got != InvalidWidth {
+		t.Errorf("an invalid byte is %d wide", got)
+	}
+	if got := CharWidth('\t', 1, 5, 8); got != 3 {
+		t.Errorf("a tab at column 5 is %d wide", got)
+	}
+}
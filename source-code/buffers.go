@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Every file named on the command line is opened in a buffer of its own,
+// with its own cursor, undo history and so on. One is shown at a time.
+
+var (
+	nextBufKey = key.NewBinding(key.WithKeys("alt+."))
+	prevBufKey = key.NewBinding(key.WithKeys("alt+,"))
+	bufListKey = key.NewBinding(key.WithKeys("alt+b"))
+)
+
+// docIndex returns the position of the current buffer in m.docs.
+func (m *model) docIndex() int {
+	for i, d := range m.docs {
+		if d == m.document {
+			return i
+		}
+	}
+	return 0
+}
+
+// switchTo makes buffer i the current one.
+func (m *model) switchTo(i int) {
+	m.document = m.docs[i]
+	m.highlight = nil
+	m.adjustScroll()
+	m.hexScroll()
+	m.status = fmt.Sprintf("[%d/%d] %s", i+1, len(m.docs), m.displayName())
+}
+
+// cycleBuffer moves to the next buffer, or the previous one if by is -1.
+func (m model) cycleBuffer(by int) (tea.Model, tea.Cmd) {
+	if len(m.docs) == 1 {
+		m.status = "No more open file buffers"
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	m.switchTo((m.docIndex() + by + len(m.docs)) % len(m.docs))
+	return m, m.clearStatusAfter(3 * time.Second)
+}
+
+// startBufferList opens the list of buffers with the current one selected.
+func (m *model) startBufferList() {
+	m.mode = "buffers"
+	m.bufferSel = m.docIndex()
+}
+
+func (m model) updateBufferList(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c", "q":
+		m.mode = "edit"
+	case "up", "k":
+		m.bufferSel = max(0, m.bufferSel-1)
+	case "down", "j":
+		m.bufferSel = min(m.bufferSel+1, len(m.docs)-1)
+	case "home":
+		m.bufferSel = 0
+	case "end":
+		m.bufferSel = len(m.docs) - 1
+	case "enter":
+		m.mode = "edit"
+		m.switchTo(m.bufferSel)
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	return m, nil
+}
+
+// renderBufferList draws the list in place of the text.
+func (m model) renderBufferList() string {
+	top := max(0, min(m.bufferSel-m.screenHeight/2, len(m.docs)-m.screenHeight))
+	lines := []string{}
+	for i := top; i < min(top+m.screenHeight, len(m.docs)); i++ {
+		d := m.docs[i]
+		marker := "  "
+		if d == m.document {
+			marker = "* "
+		}
+		line := fmt.Sprintf("%s%d: %s", marker, i+1, d.displayName())
+		if d.modified {
+			line += " (modified)"
+		}
+		if i == m.bufferSel {
+			line = cursorStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < m.screenHeight {
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// exit quits, first asking about each modified buffer in turn. With -pipe
+// the unnamed buffer is not asked about, as it goes to standard output.
+func (m model) exit() (tea.Model, tea.Cmd) {
+	return m.exitFrom(0)
+}
+
+// exitFrom asks about the first modified buffer from i on, or quits if
+// there are none left.
+func (m model) exitFrom(i int) (tea.Model, tea.Cmd) {
+	for ; i < len(m.docs); i++ {
+		d := m.docs[i]
+		if d.modified && !(m.pipe && d.filename == "") {
+			m.document = m.docs[i]
+			m.adjustScroll()
+			m.mode = "prompt"
+			return m, nil
+		}
+	}
+	m.quitting = true
+	return m, tea.Quit
+}
+
+// exitPrompt asks whether to save the current buffer before exiting.
+func (m model) exitPrompt() string {
+	if len(m.docs) == 1 {
+		return "File modified. Save changes? (Y)es (N)o ^C Cancel"
+	}
+	return fmt.Sprintf("Save modified buffer %s? (Y)es (N)o ^C Cancel", m.displayName())
+}
+
+// displayName is the name of the buffer's file, for the title bar and
+// prompts.
+func (d *document) displayName() string {
+	if d.filename == "" {
+		return "New Buffer"
+	}
+	return d.filename
+}
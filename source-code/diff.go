@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-runewidth"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffCells bounds the work done comparing the changed middle parts of
+// two texts. Beyond it they are shown as wholly replaced.
+const maxDiffCells = 1 << 22
+
+var (
+	diffAddStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#00CC00"))
+	diffDelStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF4444"))
+	diffHunkStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#00CCCC"))
+)
+
+// lineDiff returns a unified diff of the lines of a and b, or nil if they
+// are the same.
+func lineDiff(a, b string) []string {
+	if a == b {
+		return nil
+	}
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	ops := diffOps(x, y)
+
+	// Group the operations into hunks with some context around changes.
+	var out []string
+	for i := 0; i < len(ops); {
+		if ops[i] == ' ' {
+			i++
+			continue
+		}
+		start := max(0, i-diffContext)
+		end := i
+		for end < len(ops) {
+			if ops[end] != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run] == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = run
+		}
+		// Line numbers where the hunk starts in each text.
+		ax, by := 0, 0
+		for _, op := range ops[:start] {
+			if op != '+' {
+				ax++
+			}
+			if op != '-' {
+				by++
+			}
+		}
+		var lines []string
+		na, nb := 0, 0
+		for _, op := range ops[start:end] {
+			switch op {
+			case ' ':
+				lines = append(lines, " "+x[ax+na])
+				na++
+				nb++
+			case '-':
+				lines = append(lines, "-"+x[ax+na])
+				na++
+			case '+':
+				lines = append(lines, "+"+y[by+nb])
+				nb++
+			}
+		}
+		out = append(out, fmt.Sprintf("@@ -%d,%d +%d,%d @@", ax+1, na, by+1, nb))
+		out = append(out, lines...)
+		i = end
+	}
+	return out
+}
+
+// diffOps returns the edit script turning x into y: ' ' keeps a line, '-'
+// deletes one from x and '+' inserts one from y.
+func diffOps(x, y []string) []byte {
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	ops := []byte(strings.Repeat(" ", pre))
+	mx, my := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	if len(mx)*len(my) > maxDiffCells {
+		ops = append(ops, strings.Repeat("-", len(mx))...)
+		ops = append(ops, strings.Repeat("+", len(my))...)
+	} else {
+		ops = append(ops, lcsOps(mx, my)...)
+	}
+	return append(ops, strings.Repeat(" ", suf)...)
+}
+
+// lcsOps finds the edit script through the longest common subsequence.
+func lcsOps(x, y []string) []byte {
+	w := len(y) + 1
+	lcs := make([]int32, (len(x)+1)*w)
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else {
+				lcs[i*w+j] = max(lcs[(i+1)*w+j], lcs[i*w+j+1])
+			}
+		}
+	}
+	var ops []byte
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ops = append(ops, ' ')
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[(i+1)*w+j] >= lcs[i*w+j+1]):
+			ops = append(ops, '-')
+			i++
+		default:
+			ops = append(ops, '+')
+			j++
+		}
+	}
+	return ops
+}
+
+// showDiff opens a view of the differences from a to b. Leaving it goes
+// back to the given mode.
+func (m *model) showDiff(a, b, back string) {
+	m.diffLines = lineDiff(a, b)
+	if m.diffLines == nil {
+		m.diffLines = []string{"No differences"}
+	}
+	m.diffTop = 0
+	m.diffBack = back
+	m.mode = "diff"
+}
+
+func (m model) updateDiff(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	last := max(0, len(m.diffLines)-m.screenHeight)
+	switch msg.String() {
+	case "esc", "ctrl+c", "q", "enter":
+		m.mode = m.diffBack
+	case "up", "k":
+		m.diffTop = max(0, m.diffTop-1)
+	case "down", "j":
+		m.diffTop = min(m.diffTop+1, last)
+	case "pgup":
+		m.diffTop = max(0, m.diffTop-m.screenHeight)
+	case "pgdown", " ":
+		m.diffTop = min(m.diffTop+m.screenHeight, last)
+	case "home":
+		m.diffTop = 0
+	case "end":
+		m.diffTop = last
+	}
+	return m, nil
+}
+
+// renderDiff draws the diff in place of the text.
+func (m model) renderDiff() string {
+	var lines []string
+	for i := m.diffTop; i < min(m.diffTop+m.screenHeight, len(m.diffLines)); i++ {
+		line := strings.ReplaceAll(m.diffLines[i], "\t", strings.Repeat(" ", tabWidth))
+		line = runewidth.Truncate(line, m.screenWidth, "")
+		switch {
+		case strings.HasPrefix(line, "+"):
+			line = diffAddStyle.Render(line)
+		case strings.HasPrefix(line, "-"):
+			line = diffDelStyle.Render(line)
+		case strings.HasPrefix(line, "@"):
+			line = diffHunkStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < m.screenHeight {
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// diskState is what is known of the file on disk as it was last loaded or
+// saved, to notice when another program changes it.
+type diskState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// diskChangedMsg is sent by the watcher when the file of doc may have
+// changed. closed is set when the watcher has stopped.
+type diskChangedMsg struct {
+	doc    *document
+	watch  <-chan struct{} // the watcher's channel
+	closed bool
+}
+
+// recordDisk remembers the state of the file, whose content is data.
+func (m *model) recordDisk(data []byte) {
+	info, err := os.Stat(m.filename)
+	if err != nil {
+		m.disk = diskState{}
+		return
+	}
+	m.disk = diskState{exists: true, modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(data)}
+}
+
+// diskChanged reports whether the file on disk is no longer as it was last
+// loaded or saved, and returns its content if it can be read. The content is
+// only read and compared when the modification time or size differ.
+func (m *model) diskChanged() (changed bool, data []byte, err error) {
+	info, err := os.Stat(m.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m.disk.exists, nil, err
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if !m.disk.exists {
+		data, err = os.ReadFile(m.filename)
+		return true, data, err
+	}
+	if info.ModTime().Equal(m.disk.modTime) && info.Size() == m.disk.size {
+		return false, nil, nil
+	}
+	data, err = os.ReadFile(m.filename)
+	if err != nil {
+		return false, nil, err
+	}
+	if sha256.Sum256(data) != m.disk.hash {
+		return true, data, nil
+	}
+	// Touched but not changed.
+	m.disk.modTime, m.disk.size = info.ModTime(), info.Size()
+	return false, data, nil
+}
+
+// reload replaces the buffer with the file on disk as one undoable action,
+// keeping the cursor where it was as far as possible.
+func (m *model) reload() error {
+	data, err := os.ReadFile(m.filename)
+	if err != nil {
+		return err
+	}
+	text, format, err := m.decodeFile(data)
+	if errors.Is(err, errLossy) {
+		m.err = err
+	} else if err != nil {
+		return err
+	}
+	// Showing the file as it now is changes nothing, even in view mode.
+	viewOnly := m.viewOnly
+	m.viewOnly = false
+	defer func() { m.viewOnly = viewOnly }()
+	cur := m.cursor()
+	m.beginGroup()
+	m.edit(action{kind: "delete", off: 0, text: m.buf.String()})
+	m.edit(action{kind: "insert", off: 0, text: text})
+	m.setCursor(cur)
+	m.endGroup()
+	m.breakUndo()
+	m.clearMark()
+	m.adjustScroll()
+	m.modified = false
+	m.format = format
+	m.recordDisk(data)
+	if m.hex {
+		m.hexSynced()
+	}
+	return nil
+}
+
+// writeOut saves the file after checking that nobody else has changed it
+// since it was loaded, asking what to do if they have. With quit set, the
+// exit goes on to the next modified buffer once the file is saved. A buffer
+// without a name asks for one first.
+func (m model) writeOut(quit bool) (tea.Model, tea.Cmd) {
+	if m.filename == "" {
+		m.startWriteOut(quit)
+		return m, nil
+	}
+	if changed, _, _ := m.diskChanged(); changed {
+		m.mode = "diskchanged"
+		m.quitAfterSave = quit
+		return m, nil
+	}
+	return m.forceWriteOut(quit)
+}
+
+func (m model) forceWriteOut(quit bool) (tea.Model, tea.Cmd) {
+	m.mode = "edit"
+	if err := m.save(); err != nil {
+		m.err = err
+		return m, nil
+	}
+	m.modified = false
+	if quit {
+		return m.exitFrom(m.docIndex() + 1)
+	}
+	if m.err != nil {
+		return m, nil // saved, but with a warning to show
+	}
+	m.status = "File saved"
+	return m, m.clearStatusAfter(3 * time.Second)
+}
+
+// updateDiskChanged handles the question asked when saving over a file that
+// has changed on disk.
+func (m model) updateDiskChanged(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch strings.ToLower(msg.String()) {
+	case "o":
+		return m.forceWriteOut(m.quitAfterSave)
+	case "r":
+		m.mode = "edit"
+		if err := m.reload(); err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.status = "Reloaded from disk"
+		return m, m.clearStatusAfter(3 * time.Second)
+	case "d":
+		data, err := os.ReadFile(m.filename)
+		if err != nil {
+			m.mode = "edit"
+			m.err = err
+			return m, nil
+		}
+		text, _, err := m.decodeFile(data)
+		if err != nil && !errors.Is(err, errLossy) {
+			m.mode = "edit"
+			m.err = err
+			return m, nil
+		}
+		m.showDiff(text, m.buf.String(), "diskchanged")
+	case "ctrl+c", "esc":
+		m.mode = "edit"
+	}
+	return m, nil
+}
+
+// waitForDisk waits for the watcher to report a change to the file of d.
+func waitForDisk(d *document) tea.Cmd {
+	watch := d.watch
+	return func() tea.Msg {
+		_, ok := <-watch
+		return diskChangedMsg{doc: d, watch: watch, closed: !ok}
+	}
+}
+
+// diskUpdated handles a change to a file reported by the watcher. Messages
+// from a watcher since replaced are dropped.
+func (m model) diskUpdated(msg diskChangedMsg) (tea.Model, tea.Cmd) {
+	if msg.watch != msg.doc.watch {
+		return m, nil
+	}
+	if msg.closed {
+		msg.doc.watch = nil
+		return m, nil
+	}
+	m, cmd := m.compareDisk(msg.doc)
+	return m, tea.Batch(waitForDisk(msg.doc), cmd)
+}
+
+// compareDisk checks whether the file of d has changed. Messages about a
+// buffer other than the current one name its file.
+func (m model) compareDisk(d *document) (model, tea.Cmd) {
+	cur, status := m.document, m.status
+	m.document = d
+	cmd := m.checkDisk()
+	m.document = cur
+	if d != cur && m.status != status {
+		m.status = d.filename + ": " + m.status
+	}
+	return m, cmd
+}
+
+// checkDisk reloads an unmodified buffer whose file has changed, and warns
+// about a modified one. While a prompt is open the check is put off until
+// it closes.
+func (m *model) checkDisk() tea.Cmd {
+	m.diskPending = false
+	changed, data, err := m.diskChanged()
+	if !changed {
+		return nil
+	}
+	if m.mode != "edit" {
+		m.diskPending = true
+		return nil
+	}
+	if err != nil || data == nil {
+		m.status = "File on disk was removed or cannot be read"
+		return nil
+	}
+	if m.modified {
+		m.status = "File changed on disk; ^O asks whether to overwrite"
+		return nil
+	}
+	if err := m.reload(); err != nil {
+		m.err = err
+		return nil
+	}
+	m.status = "Reloaded: file changed on disk"
+	return m.clearStatusAfter(3 * time.Second)
+}
+
+// diskChangedPrompt is the question asked on saving over a changed file.
+func (m model) diskChangedPrompt() string {
+	if _, err := os.Stat(m.filename); err != nil {
+		return "File was removed on disk. (O)verwrite ^C Cancel"
+	}
+	return "File was changed on disk since it was read. (O)verwrite (R)eload (D)iff ^C Cancel"
+}
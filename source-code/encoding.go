@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// The buffer always holds UTF-8. Files in other encodings are decoded on
+// loading and encoded again on saving.
+
+var boms = map[string][]byte{
+	"UTF-8":    {0xEF, 0xBB, 0xBF},
+	"UTF-16LE": {0xFF, 0xFE},
+	"UTF-16BE": {0xFE, 0xFF},
+}
+
+// lookupEncoding finds an encoding by any of its usual names and returns
+// its canonical one. The codec is nil for UTF-8.
+func lookupEncoding(name string) (encoding.Encoding, string, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if enc == nil || err != nil {
+		enc, err = htmlindex.Get(name)
+	}
+	if enc == nil || err != nil {
+		return nil, "", fmt.Errorf("unknown encoding %q", name)
+	}
+	canonical, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		canonical, _ = ianaindex.IANA.Name(enc)
+	}
+	if canonical == "UTF-8" {
+		return nil, canonical, nil
+	}
+	return enc, canonical, nil
+}
+
+// detectEncoding guesses the encoding of a file without a byte order mark.
+// Text is taken as UTF-16 if every other byte is zero. Anything else that is
+// mostly UTF-8 stays UTF-8, including binary files and text with the odd
+// invalid byte; otherwise it is Shift_JIS if it decodes to Japanese, and
+// ISO-8859-1 as the last resort, since that can represent any byte.
+func detectEncoding(data []byte) string {
+	if name := detectUTF16(data); name != "" {
+		return name
+	}
+	if utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 || mostlyUTF8(data) {
+		return "UTF-8"
+	}
+	if s, err := japanese.ShiftJIS.NewDecoder().Bytes(data); err == nil && hasKana(string(s)) {
+		return "Shift_JIS"
+	}
+	return "ISO-8859-1"
+}
+
+// detectUTF16 recognises UTF-16 text without a byte order mark from the
+// zero bytes of ASCII characters. A few characters are too few to tell.
+func detectUTF16(data []byte) string {
+	if len(data) < 8 || len(data)%2 != 0 {
+		return ""
+	}
+	var even, odd int
+	for i := 0; i < len(data); i += 2 {
+		if data[i] == 0 {
+			even++
+		}
+		if data[i+1] == 0 {
+			odd++
+		}
+	}
+	pairs := len(data) / 2
+	switch {
+	case odd > pairs*2/5 && even == 0:
+		return "UTF-16LE"
+	case even > pairs*2/5 && odd == 0:
+		return "UTF-16BE"
+	}
+	return ""
+}
+
+// mostlyUTF8 reports whether data has at least as many valid multi-byte
+// UTF-8 sequences as invalid bytes. Text in other encodings seldom forms
+// valid sequences by chance.
+func mostlyUTF8(data []byte) bool {
+	valid, invalid := 0, 0
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			invalid++
+		case size > 1:
+			valid++
+		}
+		data = data[size:]
+	}
+	return valid >= invalid
+}
+
+func hasKana(s string) bool {
+	for _, r := range s {
+		if r >= 0x3040 && r <= 0x30FF {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBytes turns data in the given encoding into UTF-8, after removing
+// a byte order mark. It reports whether there was one.
+func decodeBytes(data []byte, name string) (string, bool, error) {
+	bom := false
+	if b := boms[name]; b != nil && bytes.HasPrefix(data, b) {
+		bom = true
+		data = data[len(b):]
+	}
+	enc, _, err := lookupEncoding(name)
+	if err != nil {
+		return "", false, err
+	}
+	if enc == nil {
+		return string(data), bom, nil
+	}
+	s, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot decode as %s: %w", name, err)
+	}
+	return string(s), bom, nil
+}
+
+// encodeString turns text into the given encoding, failing if it has
+// characters the encoding cannot represent.
+func encodeString(text, name string) ([]byte, error) {
+	enc, _, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return []byte(text), nil
+	}
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("cannot save as %s: the text has characters it cannot represent", name)
+	}
+	return data, nil
+}
+
+// sniffEncoding returns the encoding given by data's byte order mark, or a
+// guess from its content.
+func sniffEncoding(data []byte) string {
+	for _, name := range []string{"UTF-8", "UTF-16LE", "UTF-16BE"} {
+		if bytes.HasPrefix(data, boms[name]) {
+			return name
+		}
+	}
+	return detectEncoding(data)
+}
+
+// startEncoding opens the prompt for saving in another encoding.
+func (m *model) startEncoding() {
+	if m.readOnly() {
+		return
+	}
+	m.mode = "encoding"
+	m.encodingInput.SetValue("")
+	m.encodingInput.Placeholder = m.format.encoding
+	m.encodingInput.Focus()
+}
+
+func (m model) updateEncoding(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "enter":
+		m.mode = "edit"
+		name := strings.TrimSpace(m.encodingInput.Value())
+		if name == "" {
+			name = m.format.encoding
+		}
+		_, canonical, err := lookupEncoding(name)
+		if err != nil {
+			m.err = err
+			return m, nil
+		}
+		f := m.format
+		f.encoding = canonical
+		if boms[canonical] == nil {
+			f.bom = false
+		}
+		if _, err := encodeText(m.buf.String(), f); err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
+		if f != m.format {
+			m.format = f
+			m.modified = true
+		}
+		return m.writeOut(false)
+	}
+	var cmd tea.Cmd
+	m.encodingInput, cmd = m.encodingInput.Update(msg)
+	return m, cmd
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// fileFormat is how the text is laid out in the file: the buffer always
+// holds UTF-8 and separates lines with "\n", and the rest is put back on
+// saving so that the file comes back byte for byte.
+type fileFormat struct {
+	encoding string // canonical name, such as "UTF-8" or "ISO-8859-1"
+	eol      string // "\n", "\r\n" or "\r"
+	finalEOL bool   // the last line ends with eol
+	bom      bool
+}
+
+// newFileFormat is the format of files that do not exist yet.
+var newFileFormat = fileFormat{encoding: "UTF-8", eol: "\n", finalEOL: true}
+
+// errLossy is wrapped in the error decodeText returns along with the text
+// of a file decoded as UTF-8, because saving it in its encoding would not
+// give back the same bytes.
+var errLossy = errors.New("opened as UTF-8 to keep its bytes")
+
+// decodeText splits the content of a file into the text for the buffer and
+// its format. The encoding is detected unless one is given. A file only
+// counts as CRLF if every line ends that way, and as CR if it has no "\n" at
+// all; mixed files are left alone as LF, with their stray "\r"s kept in the
+// text.
+func decodeText(data []byte, encoding string) (string, fileFormat, error) {
+	if encoding == "" {
+		encoding = sniffEncoding(data)
+	}
+	_, canonical, err := lookupEncoding(encoding)
+	if err != nil {
+		return "", fileFormat{}, err
+	}
+	f := fileFormat{encoding: canonical, eol: "\n"}
+	text, bom, err := decodeBytes(data, canonical)
+	if err != nil {
+		return "", fileFormat{}, err
+	}
+	f.bom = bom
+	lf := strings.Count(text, "\n")
+	switch crlf := strings.Count(text, "\r\n"); {
+	case lf > 0 && crlf == lf:
+		f.eol = "\r\n"
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+	case lf == 0 && strings.Contains(text, "\r"):
+		f.eol = "\r"
+		text = strings.ReplaceAll(text, "\r", "\n")
+	}
+	text, f.finalEOL = strings.CutSuffix(text, "\n")
+	if canonical != "UTF-8" {
+		if back, err := encodeText(text, f); err != nil || !bytes.Equal(back, data) {
+			text, f, _ = decodeText(data, "UTF-8")
+			return text, f, fmt.Errorf("the file is not valid %s; %w", canonical, errLossy)
+		}
+	}
+	return text, f, nil
+}
+
+// encodeText is the reverse of decodeText.
+func encodeText(text string, f fileFormat) ([]byte, error) {
+	if f.finalEOL {
+		text += "\n"
+	}
+	if f.eol != "\n" {
+		text = strings.ReplaceAll(text, "\n", f.eol)
+	}
+	data, err := encodeString(text, f.encoding)
+	if err != nil {
+		return nil, err
+	}
+	if b := boms[f.encoding]; f.bom && b != nil {
+		return append(append([]byte{}, b...), data...), nil
+	}
+	return data, nil
+}
+
+// label describes the format for the title bar.
+func (f fileFormat) label() string {
+	s := f.encoding + " " + map[string]string{"\n": "LF", "\r\n": "CRLF", "\r": "CR"}[f.eol]
+	if f.bom {
+		s += " BOM"
+	}
+	if !f.finalEOL {
+		s += " noeol"
+	}
+	return s
+}
+
+func (m model) updateFormat(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	f := m.format
+	switch strings.ToLower(msg.String()) {
+	case "u":
+		f.eol = "\n"
+	case "d":
+		f.eol = "\r\n"
+	case "m":
+		f.eol = "\r"
+	case "b":
+		if boms[f.encoding] == nil {
+			m.mode = "edit"
+			m.err = fmt.Errorf("%s has no byte order mark", f.encoding)
+			return m, nil
+		}
+		f.bom = !f.bom
+	case "f":
+		f.finalEOL = !f.finalEOL
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	default:
+		return m, nil
+	}
+	m.mode = "edit"
+	if f != m.format {
+		m.format = f
+		m.modified = true
+	}
+	m.status = "File format: " + f.label()
+	return m, m.clearStatusAfter(3 * time.Second)
+}
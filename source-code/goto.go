@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+var errBadPosition = errors.New("invalid line or column number")
+
+// parseGoto parses the "line[,col]" typed at the Go To Line prompt and
+// returns a zero-based line and byte column. Lines and columns count from
+// one; a leading + or - moves relative to the cursor, and "$" stands for the
+// last line.
+func (m *model) parseGoto(spec string) (y, x int, err error) {
+	lineSpec, colSpec, hasCol := strings.Cut(strings.TrimSpace(spec), ",")
+	y, err = parseGotoNumber(lineSpec, m.cursorY, m.buf.LineCount()-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	y = max(0, min(y, m.buf.LineCount()-1))
+	if !hasCol {
+		return y, 0, nil
+	}
+	line := m.buf.Line(y)
+	x, err = parseGotoNumber(colSpec, m.cursorX, len(line))
+	if err != nil {
+		return 0, 0, err
+	}
+	return y, max(0, min(x, len(line))), nil
+}
+
+// parseGotoNumber parses one one-based number of a goto spec relative to
+// cur, or last for "$", and returns it zero-based.
+func parseGotoNumber(s string, cur, last int) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "$" {
+		return last, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errBadPosition
+	}
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		return cur + n, nil
+	}
+	if n < 1 {
+		return 0, errBadPosition
+	}
+	return n - 1, nil
+}
+
+// gotoPos moves the cursor to line y, byte column x and centres the line.
+func (m *model) gotoPos(y, x int) {
+	m.cursorY = max(0, min(y, m.buf.LineCount()-1))
+	line := m.buf.Line(m.cursorY)
+	x = max(0, min(x, len(line)))
+	for x > 0 && x < len(line) && !utf8.RuneStart(line[x]) {
+		x--
+	}
+	m.cursorX = x
+	m.targetVisualCol = visualCol(line, m.cursorX)
+	m.centerCursor()
+}
+
+// centerCursor scrolls so that the cursor line is in the middle of the
+// screen.
+func (m *model) centerCursor() {
+	m.offsetY = max(0, m.cursorY-m.height/2)
+	m.adjustScroll()
+}
+
+func (m model) updateGoto(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "ctrl+y":
+		m.mode = "edit"
+		m.gotoPos(0, 0)
+		return m, nil
+	case "ctrl+v":
+		m.mode = "edit"
+		m.gotoPos(m.buf.LineCount()-1, 0)
+		return m, nil
+	case "enter":
+		m.mode = "edit"
+		y, x, err := m.parseGoto(m.gotoInput.Value())
+		m.gotoInput.SetValue("")
+		if err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
+		m.gotoPos(y, x)
+		return m, nil
+	}
+	var cmd tea.Cmd
+	m.gotoInput, cmd = m.gotoInput.Update(msg)
+	return m, cmd
+}
+
+// fileArg is a file named on the command line and where to start in it.
+type fileArg struct {
+	name      string
+	line, col int // one-based, zero if absent
+}
+
+// parseFileArgs splits the command line into files and their starting
+// positions. Each file may be preceded by "+LINE[,COL]" or written as
+// "file:LINE[:COL]", the form printed by compilers and grep -n, unless a
+// file with that exact name exists.
+func parseFileArgs(args []string) []fileArg {
+	var files []fileArg
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "+") && i+1 < len(args) {
+			lineSpec, colSpec, _ := strings.Cut(args[i][1:], ",")
+			f := fileArg{name: args[i+1]}
+			f.line, _ = strconv.Atoi(lineSpec)
+			f.col, _ = strconv.Atoi(colSpec)
+			files = append(files, f)
+			i++
+			continue
+		}
+		files = append(files, parseFileArg(args[i]))
+	}
+	return files
+}
+
+// parseFileArg splits "file:LINE[:COL]" into its parts.
+func parseFileArg(filename string) fileArg {
+	if _, err := os.Stat(filename); err == nil {
+		return fileArg{name: filename}
+	}
+	name := strings.TrimSuffix(filename, ":")
+	var nums []int
+	for len(nums) < 2 {
+		i := strings.LastIndexByte(name, ':')
+		if i <= 0 {
+			break
+		}
+		n, err := strconv.Atoi(name[i+1:])
+		if err != nil || n < 1 {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		name = name[:i]
+	}
+	switch len(nums) {
+	case 1:
+		return fileArg{name: name, line: nums[0]}
+	case 2:
+		return fileArg{name: name, line: nums[0], col: nums[1]}
+	}
+	return fileArg{name: filename}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// In hex mode the buffer holds the bytes of the file as they are, shown as
+// rows of bytesPerRow with their offset, hex values and ASCII. Edits go
+// through m.edit like any other, so undo works on the bytes.
+const bytesPerRow = 16
+
+// rawFormat writes the buffer back byte for byte.
+var rawFormat = fileFormat{encoding: "UTF-8", eol: "\n"}
+
+var (
+	errBadOffset  = errors.New("invalid offset")
+	errBadPattern = errors.New("expected hex bytes, such as \"de ad be ef\", or a \"quoted string\"")
+)
+
+var hexOffsetStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#888888"))
+
+// isBinary reports whether data looks like something other than text: it
+// has a zero byte near the start and is not UTF-16.
+func isBinary(data []byte) bool {
+	head := data[:min(len(data), 8192)]
+	return bytes.IndexByte(head, 0) >= 0 && detectUTF16(data) == ""
+}
+
+// decodeFile is decodeText, except that in hex mode the bytes are taken as
+// they are.
+func (m *model) decodeFile(data []byte) (string, fileFormat, error) {
+	if m.hex {
+		return string(data), rawFormat, nil
+	}
+	return decodeText(data, m.format.encoding)
+}
+
+// byteAt returns the byte at off, or 0 past the end of the buffer.
+func (m *model) byteAt(off int) byte {
+	if b := m.buf.Slice(off, off+1); b != "" {
+		return b[0]
+	}
+	return 0
+}
+
+// hexEdit applies edits as one undo step that moves the cursor from where
+// it is to offset after. The second digit of a byte joins the step of the
+// first.
+func (m *model) hexEdit(after int, edits ...action) {
+	if m.readOnly() {
+		return
+	}
+	m.cursorY, m.cursorX = m.buf.Position(m.hexCursor)
+	if m.hexStep != nil && m.hexStep == m.history.current {
+		m.groupDepth++
+	} else {
+		m.beginGroup()
+	}
+	for _, a := range edits {
+		m.edit(a)
+	}
+	m.cursorY, m.cursorX = m.buf.Position(after)
+	m.endGroup()
+	m.hexCursor = after
+	m.hexStep = nil
+}
+
+// hexSetByte replaces the byte at off with b.
+func (m *model) hexSetByte(off int, b byte, after int) {
+	m.hexEdit(after,
+		action{kind: "delete", off: off, text: m.buf.Slice(off, off+1)},
+		action{kind: "insert", off: off, text: string([]byte{b})})
+}
+
+// hexTypeNibble enters one hex digit at the cursor. In insert mode the
+// first digit of a byte inserts a new byte.
+func (m *model) hexTypeNibble(v byte) {
+	if m.readOnly() {
+		return
+	}
+	off := m.hexCursor
+	if m.hexNibble == 1 && off < m.buf.Len() {
+		m.hexSetByte(off, m.byteAt(off)&0xF0|v, off+1)
+		m.hexNibble = 0
+		return
+	}
+	if m.hexInsert || off == m.buf.Len() {
+		m.hexEdit(off, action{kind: "insert", off: off, text: string([]byte{v << 4})})
+	} else {
+		m.hexSetByte(off, m.byteAt(off)&0x0F|v<<4, off)
+	}
+	m.hexNibble = 1
+	m.hexStep = m.history.current
+}
+
+// hexTypeByte enters b at the cursor from the ASCII column.
+func (m *model) hexTypeByte(b byte) {
+	if m.readOnly() {
+		return
+	}
+	off := m.hexCursor
+	if m.hexInsert || off == m.buf.Len() {
+		m.hexEdit(off+1, action{kind: "insert", off: off, text: string([]byte{b})})
+	} else {
+		m.hexSetByte(off, b, off+1)
+	}
+	m.hexNibble = 0
+}
+
+// hexMove moves the cursor to off, keeping it on the file or just after it.
+func (m *model) hexMove(off int) {
+	m.hexCursor = max(0, min(off, m.buf.Len()))
+	m.hexNibble = 0
+	m.hexStep = nil
+	m.hexScroll()
+}
+
+// hexScroll keeps the cursor's row on screen.
+func (m *model) hexScroll() {
+	row := m.hexCursor / bytesPerRow
+	if row < m.hexTop {
+		m.hexTop = row
+	}
+	if m.height > 0 && row >= m.hexTop+m.height {
+		m.hexTop = row - m.height + 1
+	}
+}
+
+// hexSynced picks up the cursor after undo or redo has moved it.
+func (m *model) hexSynced() {
+	m.hexMove(m.cursorOffset())
+}
+
+// parseOffset parses the offset typed at the go-to prompt in hex mode:
+// decimal, or hex with 0x, optionally relative to the cursor with + or -.
+func (m *model) parseOffset(spec string) (int, error) {
+	spec = strings.TrimSpace(spec)
+	base := 0
+	if spec != "" && (spec[0] == '+' || spec[0] == '-') {
+		base = m.hexCursor
+	}
+	n, err := strconv.ParseInt(spec, 0, 64)
+	if err != nil {
+		return 0, errBadOffset
+	}
+	return base + int(n), nil
+}
+
+// parseHexPattern parses a search for bytes: pairs of hex digits, spaces
+// allowed, or text in double quotes.
+func parseHexPattern(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1], nil
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil || len(b) == 0 {
+		return "", errBadPattern
+	}
+	return string(b), nil
+}
+
+// hexFind moves to the next occurrence of the bytes after the cursor, or
+// the previous one before it, wrapping around the file.
+func (m model) hexFind(spec string, backward bool) (tea.Model, tea.Cmd) {
+	pat, err := parseHexPattern(spec)
+	if err != nil {
+		m.err = err
+		return m, nil
+	}
+	data := m.buf.String()
+	cur, wrapped := m.hexCursor, false
+	i := -1
+	if backward {
+		if i = strings.LastIndex(data[:cur], pat); i < 0 {
+			i, wrapped = strings.LastIndex(data, pat), true
+		}
+	} else {
+		start := min(cur+1, len(data))
+		if i = strings.Index(data[start:], pat); i >= 0 {
+			i += start
+		} else {
+			i, wrapped = strings.Index(data, pat), true
+		}
+	}
+	if i < 0 {
+		m.status = "Not found: " + spec
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	m.hexMove(i)
+	if wrapped {
+		m.status = "Search Wrapped"
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	return m, nil
+}
+
+func (m model) updateHexSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "enter":
+		m.mode = "edit"
+		spec := m.searchInput.Value()
+		if spec == "" {
+			spec = m.lastHexSearch
+		}
+		if spec == "" {
+			return m, nil
+		}
+		m.lastHexSearch = spec
+		return m.hexFind(spec, false)
+	}
+	var cmd tea.Cmd
+	m.searchInput, cmd = m.searchInput.Update(msg)
+	return m, cmd
+}
+
+func (m model) updateHexGoto(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "ctrl+y":
+		m.mode = "edit"
+		m.hexMove(0)
+		return m, nil
+	case "ctrl+v":
+		m.mode = "edit"
+		m.hexMove(m.buf.Len())
+		return m, nil
+	case "enter":
+		m.mode = "edit"
+		off, err := m.parseOffset(m.gotoInput.Value())
+		m.gotoInput.SetValue("")
+		if err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
+		m.hexMove(off)
+		return m, nil
+	}
+	var cmd tea.Cmd
+	m.gotoInput, cmd = m.gotoInput.Update(msg)
+	return m, cmd
+}
+
+// updateHex handles keys in hex mode. The keys for saving, exiting, undo
+// and so on do what they do elsewhere; the rest move around and edit bytes.
+func (m model) updateHex(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if msg.Type != tea.KeyRunes {
+		m.breakUndo()
+		m.hexStep = nil
+	}
+	switch {
+	case key.Matches(msg, saveKey):
+		m.startWriteOut(false)
+		return m, nil
+	case key.Matches(msg, exitKey):
+		return m.exit()
+	case key.Matches(msg, nextBufKey):
+		return m.cycleBuffer(1)
+	case key.Matches(msg, prevBufKey):
+		return m.cycleBuffer(-1)
+	case key.Matches(msg, bufListKey):
+		m.startBufferList()
+		return m, nil
+	case key.Matches(msg, readKey):
+		m.startRead()
+		return m, nil
+	case key.Matches(msg, splitKey), key.Matches(msg, vsplitKey):
+		m.split(key.Matches(msg, vsplitKey))
+		return m, nil
+	case key.Matches(msg, focusKey):
+		return m.cycleFocus()
+	case key.Matches(msg, closeKey):
+		return m.closeView()
+	case key.Matches(msg, posKey):
+		m.status = fmt.Sprintf("Offset 0x%X (%d) of %d bytes", m.hexCursor, m.hexCursor, m.buf.Len())
+		return m, m.clearStatusAfter(3 * time.Second)
+	case key.Matches(msg, undoKey):
+		m.undo()
+		m.hexSynced()
+		return m, nil
+	case key.Matches(msg, redoKey):
+		m.redo()
+		m.hexSynced()
+		return m, nil
+	case key.Matches(msg, searchKey):
+		m.mode = "hexsearch"
+		m.searchInput.SetValue("")
+		m.searchInput.Placeholder = m.lastHexSearch
+		m.searchInput.Focus()
+		return m, nil
+	case key.Matches(msg, nextKey), key.Matches(msg, prevKey):
+		if m.lastHexSearch == "" {
+			m.status = "No current search pattern"
+			return m, m.clearStatusAfter(3 * time.Second)
+		}
+		return m.hexFind(m.lastHexSearch, key.Matches(msg, prevKey))
+	case key.Matches(msg, gotoKey):
+		m.mode = "hexgoto"
+		m.gotoInput.Focus()
+		return m, nil
+	}
+	switch msg.Type {
+	case tea.KeyLeft:
+		if m.hexNibble == 1 {
+			m.hexNibble = 0
+		} else if m.hexCursor > 0 {
+			m.hexMove(m.hexCursor - 1)
+			if !m.hexASCII && m.hexCursor < m.buf.Len() {
+				m.hexNibble = 1
+			}
+		}
+	case tea.KeyRight:
+		if m.hexNibble == 0 && !m.hexASCII && m.hexCursor < m.buf.Len() {
+			m.hexNibble = 1
+		} else {
+			m.hexMove(m.hexCursor + 1)
+		}
+	case tea.KeyUp:
+		m.hexMove(m.hexCursor - bytesPerRow)
+	case tea.KeyDown:
+		m.hexMove(m.hexCursor + bytesPerRow)
+	case tea.KeyPgUp:
+		m.hexMove(m.hexCursor - bytesPerRow*max(1, m.height))
+	case tea.KeyPgDown:
+		m.hexMove(m.hexCursor + bytesPerRow*max(1, m.height))
+	case tea.KeyHome:
+		m.hexMove(m.hexCursor - m.hexCursor%bytesPerRow)
+	case tea.KeyEnd:
+		m.hexMove(min(m.hexCursor-m.hexCursor%bytesPerRow+bytesPerRow-1, m.buf.Len()))
+	case tea.KeyTab:
+		m.hexASCII = !m.hexASCII
+		m.hexNibble = 0
+	case tea.KeyInsert:
+		m.hexInsert = !m.hexInsert
+	case tea.KeyBackspace:
+		if off := m.hexCursor; off > 0 {
+			m.hexEdit(off-1, action{kind: "delete", off: off - 1, text: m.buf.Slice(off-1, off)})
+			m.hexNibble = 0
+		}
+	case tea.KeyDelete:
+		if off := m.hexCursor; off < m.buf.Len() {
+			m.hexEdit(off, action{kind: "delete", off: off, text: m.buf.Slice(off, off+1)})
+			m.hexNibble = 0
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		if msg.Alt {
+			break
+		}
+		// Several runes come at once when pasted or typed quickly.
+		for _, r := range msg.Runes {
+			if m.hexASCII {
+				if r >= 0x20 && r < 0x7F {
+					m.hexTypeByte(byte(r))
+				}
+			} else if v, err := strconv.ParseUint(string(r), 16, 8); err == nil {
+				m.hexTypeNibble(byte(v))
+			}
+		}
+	}
+	m.hexScroll()
+	return m, nil
+}
+
+// renderHex draws the rows of bytes in place of the text.
+func (m model) renderHex() string {
+	n := m.buf.Len()
+	start := m.hexTop * bytesPerRow
+	data := m.buf.Slice(start, min(n, start+m.height*bytesPerRow))
+	var lines []string
+	for row := 0; row < m.height; row++ {
+		off := start + row*bytesPerRow
+		if off > n || (off == n && m.hexCursor != n) {
+			lines = append(lines, "")
+			continue
+		}
+		var hexCol, asciiCol strings.Builder
+		for i := 0; i < bytesPerRow; i++ {
+			if i == bytesPerRow/2 {
+				hexCol.WriteByte(' ')
+			}
+			at := off + i
+			if at >= n {
+				digits, ch := "  ", " "
+				if at == m.hexCursor && !m.unfocused {
+					digits, ch = cursorStyle.Render("  "), cursorStyle.Render(" ")
+				}
+				hexCol.WriteString(digits + " ")
+				asciiCol.WriteString(ch)
+				continue
+			}
+			b := data[at-start]
+			digits := fmt.Sprintf("%02X", b)
+			ch := "."
+			if b >= 0x20 && b < 0x7F {
+				ch = string(rune(b))
+			}
+			if at == m.hexCursor && !m.unfocused {
+				if m.hexASCII {
+					ch = cursorStyle.Render(ch)
+				} else {
+					digits = digits[:m.hexNibble] + cursorStyle.Render(digits[m.hexNibble:m.hexNibble+1]) + digits[m.hexNibble+1:]
+				}
+			}
+			hexCol.WriteString(digits + " ")
+			asciiCol.WriteString(ch)
+		}
+		lines = append(lines, hexOffsetStyle.Render(fmt.Sprintf("%08X", off))+"  "+hexCol.String()+" |"+asciiCol.String()+"|")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hexLabel describes the editing mode for the title bar.
+func (m model) hexLabel() string {
+	if m.hexInsert {
+		return "HEX INS"
+	}
+	return "HEX OVR"
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Undo history is kept between sessions in one file per edited file under
+// $XDG_STATE_HOME/hedit/undo, named after a hash of the file's absolute
+// path. It is written whenever the file is saved, together with a hash of
+// the saved content and how it was decoded, and only loaded again if the
+// file still has exactly that content and is opened the same way: offsets
+// into the decoded text mean nothing in hex mode, nor in another encoding.
+
+// maxHistory is the most text the stored undo history of a file may hold,
+// so that reloading or replacing a large file does not keep adding its size
+// to the history on disk.
+const maxHistory = 16 << 20
+
+// historyFile is the on-disk form of the undo tree. It is encoded with gob
+// rather than JSON so that text which is not valid UTF-8 survives the round
+// trip.
+type historyFile struct {
+	Path    string
+	Hash    [sha256.Size]byte
+	Hex     bool
+	Format  savedFormat
+	Nodes   []savedNode // in the order of undoTree.nodes
+	Current int
+}
+
+type savedFormat struct {
+	Encoding string
+	EOL      string
+	FinalEOL bool
+	BOM      bool
+}
+
+func saveFormat(f fileFormat) savedFormat {
+	return savedFormat{Encoding: f.encoding, EOL: f.eol, FinalEOL: f.finalEOL, BOM: f.bom}
+}
+
+type savedNode struct {
+	Parent int // -1 for the root
+	Redo   int
+	Action savedAction
+}
+
+type savedAction struct {
+	Kind          string
+	Off           int
+	Text          string
+	Group         []savedAction
+	Before, After [2]int
+	Time          time.Time
+}
+
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "hedit"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "hedit"), nil
+}
+
+// statePath returns the absolute path of filename and where state of the
+// given kind, such as its undo history, is kept for it.
+func statePath(filename, kind string) (abs, path string, err error) {
+	abs, err = filepath.Abs(filename)
+	if err != nil {
+		return "", "", err
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return abs, filepath.Join(dir, kind, hex.EncodeToString(sum[:16])), nil
+}
+
+// writeStateFile replaces the file at path with data, readable only by the
+// user, creating its directory if need be.
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// storeHistory writes the undo history of a file that has just been saved
+// with the given content.
+func (m *model) storeHistory(content []byte) error {
+	abs, path, err := statePath(m.filename, "undo")
+	if err != nil {
+		return err
+	}
+	nodes := storedNodes(m.history)
+	index := make(map[*undoNode]int, len(nodes))
+	for i, n := range nodes {
+		index[n] = i
+	}
+	h := historyFile{
+		Path:    abs,
+		Hash:    sha256.Sum256(content),
+		Hex:     m.hex,
+		Format:  saveFormat(m.format),
+		Nodes:   make([]savedNode, len(nodes)),
+		Current: index[m.history.current],
+	}
+	h.Nodes[0] = savedNode{Parent: -1}
+	for i, n := range nodes[1:] {
+		h.Nodes[i+1] = savedNode{Parent: index[n.parent], Action: saveActions([]action{n.action})[0]}
+	}
+	// Redo counts among the children that were kept.
+	for i, n := range nodes {
+		for _, c := range n.children[:min(n.redo, len(n.children))] {
+			if _, ok := index[c]; ok {
+				h.Nodes[i].Redo++
+			}
+		}
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(h); err != nil {
+		return err
+	}
+	return writeStateFile(path, data.Bytes())
+}
+
+// storedNodes picks the nodes of the undo tree to store, in the order they
+// were made, holding at most maxHistory bytes of text. The changes leading
+// to the current state come first and branches off them next, as far as
+// they fit. The first node is the root of what is stored: the state before
+// the oldest change kept on the way to the current one.
+func storedNodes(t *undoTree) []*undoNode {
+	budget := maxHistory
+	keep := map[*undoNode]bool{}
+	root := t.current
+	for root.parent != nil {
+		size := actionSize(root.action)
+		if size > budget {
+			break
+		}
+		budget -= size
+		keep[root] = true
+		root = root.parent
+	}
+	keep[root] = true
+	nodes := []*undoNode{root}
+	for _, n := range t.nodes[root.seq+1:] {
+		if !keep[n] && keep[n.parent] && actionSize(n.action) <= budget {
+			budget -= actionSize(n.action)
+			keep[n] = true
+		}
+		if keep[n] {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// actionSize is the amount of text held by a.
+func actionSize(a action) int {
+	size := len(a.text)
+	for _, child := range a.group {
+		size += actionSize(child)
+	}
+	return size
+}
+
+// loadHistory restores the undo history stored for the file, provided the
+// file still has the content it was stored with and has been decoded the
+// same way. Stale history is removed; history for another decoding is
+// kept for when the file is opened that way again.
+func (m *model) loadHistory(content []byte) {
+	abs, path, err := statePath(m.filename, "undo")
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var h historyFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&h); err != nil ||
+		h.Path != abs || h.Hash != sha256.Sum256(content) {
+		os.Remove(path)
+		return
+	}
+	if h.Hex != m.hex || h.Format != saveFormat(m.format) {
+		return
+	}
+	if t := loadTree(h); t != nil {
+		m.history = t
+		m.breakUndo()
+	}
+}
+
+// loadTree rebuilds the undo tree from its saved form. It returns nil if the
+// nodes do not form a tree.
+func loadTree(h historyFile) *undoTree {
+	if len(h.Nodes) == 0 || h.Nodes[0].Parent != -1 || h.Current < 0 || h.Current >= len(h.Nodes) {
+		return nil
+	}
+	t := &undoTree{nodes: make([]*undoNode, len(h.Nodes))}
+	for i, s := range h.Nodes {
+		n := &undoNode{action: loadActions([]savedAction{s.Action})[0], seq: i}
+		if i > 0 {
+			if s.Parent < 0 || s.Parent >= i {
+				return nil
+			}
+			n.parent = t.nodes[s.Parent]
+			n.parent.children = append(n.parent.children, n)
+		}
+		t.nodes[i] = n
+	}
+	for i, n := range t.nodes {
+		if r := h.Nodes[i].Redo; r >= 0 && r < len(n.children) {
+			n.redo = r
+		}
+	}
+	t.current = t.nodes[h.Current]
+	return t
+}
+
+func saveActions(actions []action) []savedAction {
+	if len(actions) == 0 {
+		return nil
+	}
+	saved := make([]savedAction, len(actions))
+	for i, a := range actions {
+		saved[i] = savedAction{
+			Kind:   a.kind,
+			Off:    a.off,
+			Text:   a.text,
+			Group:  saveActions(a.group),
+			Before: [2]int{a.before.y, a.before.x},
+			After:  [2]int{a.after.y, a.after.x},
+			Time:   a.time,
+		}
+	}
+	return saved
+}
+
+func loadActions(saved []savedAction) []action {
+	if len(saved) == 0 {
+		return nil
+	}
+	actions := make([]action, len(saved))
+	for i, s := range saved {
+		actions[i] = action{
+			kind:   s.Kind,
+			off:    s.Off,
+			text:   s.Text,
+			group:  loadActions(s.Group),
+			before: cursorPos{s.Before[0], s.Before[1]},
+			after:  cursorPos{s.After[0], s.After[1]},
+			time:   s.Time,
+		}
+	}
+	return actions
+}
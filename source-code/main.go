@@ -1,14 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
+	"hedit/buffer"
+
 	"github.com/alecthomas/chroma/v2"
 	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/alecthomas/chroma/v2/styles"
@@ -18,132 +24,305 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/mattn/go-runewidth"
+	"github.com/muesli/termenv"
 )
 
 type errMsg error
 type clearStatusMsg struct{}
 
-type action struct {
-	kind string // "insert", "delete", "split", "join"
-	y    int
-	x    int
-	text string
-}
-
+// model is the editor. The file being edited is the embedded document; all
+// open files are in docs.
 type model struct {
-	lines          []string
-	cursorY        int
-	cursorX        int // byte index
-	offsetY        int
-	offsetX        int // visual column offset
+	*document
+	docs           []*document
+	bufferSel      int // selected row in the buffer list
+	layout         *pane
+	focus          *pane
+	screenWidth    int // the space for the views
+	screenHeight   int
+	unfocused      bool // drawing a view without the focus
 	width          int
 	height         int
-	filename       string
-	modified       bool
+	backup         backupPolicy
 	err            error
 	status         string
 	quitting       bool
-	mode           string // "edit", "prompt", "search"
-	lexer          chroma.Lexer
+	mode           string // "edit", "prompt", "search", "replace", "replacewith", "replaceconfirm", "goto", "undotree", "travel", "swap", "swaplocked", "diff", "diskchanged", "format", "encoding", "hexsearch", "hexgoto", "buffers", "readfile", "readcmd", "writeout", "overwrite"
 	theme          *chroma.Style
-	cachedTokens   map[int][]chroma.Token
-	undoStack      []action
-	redoStack      []action
+	undoRows       []undoRow
+	undoSel        int // selected row in the undo tree browser
+	travelInput    textinput.Model
 	searchInput    textinput.Model
-	lineNumWidth   int
+	searchOpts     searchOptions
+	lastSearch     string
+	searchOrigin   viewPos
+	searchFound    bool
+	highlight      *matcher // matches to highlight while searching
+	matchStyle     lipgloss.Style
+	matchIndex     int
+	matchCount     int
+	selectionStyle lipgloss.Style
+	replaceInput   textinput.Model
+	replace        replaceState
+	gotoInput      textinput.Model
+	encodingInput  textinput.Model
+	readInput      textinput.Model
+	writeInput     textinput.Model
+	writeMode      string   // "", "append" or "prepend"
+	writePath      string   // the file being written at the overwrite question
+	completions    []string // offered by Tab at the Read File prompt
+	diffLines      []string
+	diffTop        int
+	diffBack       string // mode to return to from the diff view
+	quitAfterSave  bool
+	pipe           bool // the unnamed buffer goes to standard output on exit
+	viewOnly       bool // -v: nothing may be changed or saved
+	pager          bool // run as hview: the keys are those of less
+	lastHexSearch  string
+}
+
+// document is the state of one open file.
+type document struct {
+	buf             *buffer.Buffer
+	cursorY         int
+	cursorX         int // byte index
+	offsetY         int
+	offsetX         int // visual column offset
+	filename        string
+	modified        bool
+	format          fileFormat
+	lexer           chroma.Lexer
+	cachedTokens    map[int][]chroma.Token
+	history         *undoTree
+	groupDepth      int  // pushUndo adds to the group at the current node
+	undoBreak       bool // the next edit starts a new undo step
+	markSet         bool
+	softMark        bool // set by shift+movement; plain movement unsets it
+	markY           int
+	markX           int // byte index
+	lineNumWidth    int
 	targetVisualCol int
+	changes         int    // edits applied to the buffer
+	swapPath        string // empty while there is no swap file of our own
+	swapChanges     int    // changes and modified when the swap file was written
+	swapModified    bool
+	staleSwap       *swapFile // found on startup and not yet dealt with
+	disk            diskState
+	watch           <-chan struct{} // changes to the file, with -watch
+	unwatch         func()          // stops watch
+	diskPending     bool            // a change reported while a prompt was open
+	hex             bool
+	hexCursor       int       // byte offset
+	hexNibble       int       // 0 for the high half of the byte, 1 for the low
+	hexTop          int       // first row on screen
+	hexInsert       bool      // typing inserts bytes rather than overwriting
+	hexASCII        bool      // typing goes to the ASCII column
+	hexStep         *undoNode // the undo step of a half-typed byte
 }
 
 var (
 	titleStyle = lipgloss.NewStyle().
-		Foreground(lipgloss.Color("#FAFAFA")).
-		Background(lipgloss.Color("#7D56F4")).
-		Padding(0, 1).
-		Width(80) // Will adjust
+			Foreground(lipgloss.Color("#FAFAFA")).
+			Background(lipgloss.Color("#7D56F4")).
+			Padding(0, 1).
+			Width(80) // Will adjust
 	footerStyle = lipgloss.NewStyle().
-		Foreground(lipgloss.Color("#626262")).
-		Height(2)
+			Foreground(lipgloss.Color("#626262")).
+			Height(2)
 	helpStyle = lipgloss.NewStyle().
-		Foreground(lipgloss.Color("#626262")).
-		Margin(1, 0, 0, 0)
+			Foreground(lipgloss.Color("#626262")).
+			Margin(1, 0, 0, 0)
 	errorStyle = lipgloss.NewStyle().
-		Foreground(lipgloss.Color("#FF0000")).
-		Margin(1, 0, 0, 0)
+			Foreground(lipgloss.Color("#FF0000")).
+			Margin(1, 0, 0, 0)
 	lineNumberStyle = lipgloss.NewStyle().
-		Foreground(lipgloss.Color("#888888")).
-		Align(lipgloss.Right)
+			Foreground(lipgloss.Color("#888888")).
+			Align(lipgloss.Right)
 	cursorStyle = lipgloss.NewStyle().
-		Reverse(true)
+			Reverse(true)
+	invalidStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("#FF5F87"))
 	promptStyle = lipgloss.NewStyle().
-		Foreground(lipgloss.Color("#FFFF00")).
-		Background(lipgloss.Color("#000000")).
-		Padding(1)
-	saveKey   = key.NewBinding(key.WithKeys("ctrl+o"))
-	exitKey   = key.NewBinding(key.WithKeys("ctrl+x"))
-	posKey    = key.NewBinding(key.WithKeys("ctrl+c"))
-	undoKey   = key.NewBinding(key.WithKeys("ctrl+z"))
-	redoKey   = key.NewBinding(key.WithKeys("ctrl+y"))
-	searchKey = key.NewBinding(key.WithKeys("ctrl+w"))
-	cutKey    = key.NewBinding(key.WithKeys("ctrl+k"))
-	copyKey   = key.NewBinding(key.WithKeys("ctrl+p")) // Changed to ctrl+p since ctrl+y is redo
-	pasteKey  = key.NewBinding(key.WithKeys("ctrl+u"))
-	tabWidth  = 4
+			Foreground(lipgloss.Color("#FFFF00")).
+			Background(lipgloss.Color("#000000")).
+			Padding(1)
+	saveKey    = key.NewBinding(key.WithKeys("ctrl+o"))
+	exitKey    = key.NewBinding(key.WithKeys("ctrl+x"))
+	posKey     = key.NewBinding(key.WithKeys("ctrl+c"))
+	undoKey    = key.NewBinding(key.WithKeys("ctrl+z"))
+	redoKey    = key.NewBinding(key.WithKeys("ctrl+y"))
+	treeKey    = key.NewBinding(key.WithKeys("alt+z"))
+	travelKey  = key.NewBinding(key.WithKeys("alt+t"))
+	formatKey  = key.NewBinding(key.WithKeys("alt+d"))
+	encodeKey  = key.NewBinding(key.WithKeys("alt+e"))
+	searchKey  = key.NewBinding(key.WithKeys("ctrl+w"))
+	replaceKey = key.NewBinding(key.WithKeys("ctrl+\\"))
+	gotoKey    = key.NewBinding(key.WithKeys("ctrl+_", "alt+g"))
+	nextKey    = key.NewBinding(key.WithKeys("alt+w"))
+	prevKey    = key.NewBinding(key.WithKeys("alt+q"))
+	cutKey     = key.NewBinding(key.WithKeys("ctrl+k"))
+	copyKey    = key.NewBinding(key.WithKeys("ctrl+p")) // Changed to ctrl+p since ctrl+y is redo
+	pasteKey   = key.NewBinding(key.WithKeys("ctrl+u"))
+	markKey    = key.NewBinding(key.WithKeys("ctrl+^", "alt+a"))
+	indentKey  = key.NewBinding(key.WithKeys("alt+}"))
+	outdentKey = key.NewBinding(key.WithKeys("alt+{"))
+	upperKey   = key.NewBinding(key.WithKeys("alt+u"))
+	lowerKey   = key.NewBinding(key.WithKeys("alt+l"))
+	tabWidth   = 4
 )
 
-func initialModel(filename, themeName string) model {
-	content := ""
-	if _, err := os.Stat(filename); err == nil {
+// openOptions say how to open a file.
+type openOptions struct {
+	encoding string // decode from this encoding rather than detecting one
+	hex      bool   // open in hex mode, as binary files are anyway
+	view     bool   // only to look at, so without a swap file
+}
+
+// initialModel opens the files, each in a buffer of its own, and starts
+// with the first.
+func initialModel(filenames []string, themeName string, opts openOptions) model {
+	theme := styles.Get(themeName)
+	if theme == nil {
+		theme = styles.Fallback
+	}
+	searchInput := textinput.New()
+	searchInput.Placeholder = "Search for..."
+	replaceInput := textinput.New()
+	replaceInput.Placeholder = "Replace with..."
+	gotoInput := textinput.New()
+	gotoInput.Placeholder = "line[,column]"
+	encodingInput := textinput.New()
+	readInput := textinput.New()
+	writeInput := textinput.New()
+	travelInput := textinput.New()
+	travelInput.Placeholder = "5m"
+	m := model{
+		backup:         backupPolicy{mode: "simple"},
+		theme:          theme,
+		mode:           "edit",
+		searchInput:    searchInput,
+		replaceInput:   replaceInput,
+		gotoInput:      gotoInput,
+		travelInput:    travelInput,
+		encodingInput:  encodingInput,
+		readInput:      readInput,
+		writeInput:     writeInput,
+		matchStyle:     matchStyleFor(theme),
+		selectionStyle: selectionStyleFor(theme),
+		viewOnly:       opts.view,
+	}
+	for _, filename := range filenames {
+		m.open(filename, opts)
+	}
+	m.document = m.docs[0]
+	m.layout = &pane{view: &view{doc: m.document}}
+	m.focus = m.layout
+	m.mode = "edit"
+	m.nextSwapPrompt()
+	return m
+}
+
+// open reads a file into a new buffer and makes it the current one. The
+// file "-" is standard input, read into a buffer without a name.
+func (m *model) open(filename string, opts openOptions) {
+	var content []byte
+	exists := false
+	if filename == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			m.err = fmt.Errorf("reading standard input: %w", err)
+		}
+		content, filename = data, ""
+	} else if _, err := os.Stat(filename); err == nil {
 		data, err := os.ReadFile(filename)
 		if err == nil {
-			content = string(data)
+			content = data
+			exists = true
 		}
 	}
-	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
-	if len(lines) == 0 {
-		lines = []string{""}
+	hexMode := opts.hex || (opts.encoding == "" && isBinary(content))
+	text, format, decodeErr := decodeText(content, opts.encoding)
+	if decodeErr != nil && !errors.Is(decodeErr, errLossy) {
+		text, format, _ = decodeText(content, "")
 	}
+	if !exists && filename != "" {
+		format = newFileFormat
+		if _, name, err := lookupEncoding(opts.encoding); err == nil && opts.encoding != "" {
+			format.encoding = name
+		}
+	}
+	if hexMode {
+		text, format, decodeErr = string(content), rawFormat, nil
+	}
+	buf := buffer.New(text)
 	lexer := lexers.Match(filename)
+	if lexer == nil && filename == "" {
+		lexer = lexers.Analyse(text)
+	}
 	if lexer == nil {
 		lexer = lexers.Fallback
 	}
-	theme := styles.Get(themeName)
-	if theme == nil {
-		theme = styles.Fallback
-	}
-	searchInput := textinput.New()
-	searchInput.Placeholder = "Search for..."
-	lineNumWidth := len(fmt.Sprint(len(lines))) + 1
+	lineNumWidth := len(fmt.Sprint(buf.LineCount())) + 1
 	if lineNumWidth < 4 {
 		lineNumWidth = 4
 	}
-	m := model{
-		lines:         lines,
-		filename:      filename,
-		lexer:         lexer,
-		theme:         theme,
-		mode:          "edit",
-		cachedTokens:  make(map[int][]chroma.Token),
-		searchInput:   searchInput,
-		lineNumWidth:  lineNumWidth,
+	m.document = &document{
+		buf:             buf,
+		filename:        filename,
+		hex:             hexMode,
+		format:          format,
+		lexer:           lexer,
+		cachedTokens:    make(map[int][]chroma.Token),
+		history:         newUndoTree(),
+		lineNumWidth:    lineNumWidth,
 		targetVisualCol: 0,
 	}
-	return m
+	m.docs = append(m.docs, m.document)
+	if exists {
+		m.recordDisk(content)
+		m.loadHistory(content)
+	}
+	if decodeErr != nil {
+		m.err = decodeErr
+	}
+	if !opts.view {
+		m.openSwap()
+	}
 }
 
 func (m model) Init() tea.Cmd {
-	return nil
+	_, swap := m.updateSwap() // the swap files claimed on opening
+	cmds := []tea.Cmd{swap}
+	for _, d := range m.docs {
+		if d.watch != nil {
+			cmds = append(cmds, waitForDisk(d))
+		}
+	}
+	return tea.Batch(cmds...)
 }
 
+// save writes the buffer to the file. Problems that do not stop the file
+// from being saved, such as a failed backup, are left in m.err.
 func (m *model) save() error {
-	// Backup
-	if _, err := os.Stat(m.filename); err == nil {
-		data, err := os.ReadFile(m.filename)
-		if err == nil {
-			os.WriteFile(m.filename+".bak", data, 0644)
-		}
+	if m.viewOnly {
+		return errViewMode
 	}
-	content := strings.Join(m.lines, "\n") + "\n"
-	return os.WriteFile(m.filename, []byte(content), 0644)
+	m.err = nil
+	content, err := encodeText(m.buf.String(), m.format)
+	if err != nil {
+		return err
+	}
+	if err := m.backup.backup(m.filename); err != nil {
+		m.err = fmt.Errorf("backup not written: %w", err)
+	}
+	if err := writeFileAtomic(m.filename, content); err != nil {
+		return err
+	}
+	m.recordDisk(content)
+	if err := m.storeHistory(content); err != nil {
+		m.err = fmt.Errorf("undo history not saved: %w", err)
+	}
+	return nil
 }
 
 func (m *model) invalidateCache(y int) {
@@ -151,202 +330,265 @@ func (m *model) invalidateCache(y int) {
 }
 
 func (m *model) updateLineNumWidth() {
-	digits := len(fmt.Sprint(len(m.lines)))
+	digits := len(fmt.Sprint(m.buf.LineCount()))
 	m.lineNumWidth = digits + 1
 	if m.lineNumWidth < 4 {
 		m.lineNumWidth = 4
 	}
 }
 
-func (m *model) pushUndo(a action) {
-	m.undoStack = append(m.undoStack, a)
-	m.redoStack = nil // Clear redo on new action
+func (m *model) cursor() cursorPos {
+	return cursorPos{m.cursorY, m.cursorX}
 }
 
-func inverse(a action) action {
-	switch a.kind {
-	case "insert":
-		return action{kind: "delete", y: a.y, x: a.x, text: a.text}
-	case "delete":
-		return action{kind: "insert", y: a.y, x: a.x, text: a.text}
-	case "split":
-		return action{kind: "join", y: a.y + 1, x: a.x, text: ""}
-	case "join":
-		return action{kind: "split", y: a.y, x: a.x, text: ""}
-	}
-	return action{}
+func (m *model) setCursor(p cursorPos) {
+	m.cursorY = max(0, min(p.y, m.buf.LineCount()-1))
+	m.cursorX = max(0, min(p.x, m.buf.LineLen(m.cursorY)))
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 }
 
+// applyAction changes the buffer as described by a and leaves the cursor
+// after the inserted text or at the start of the deleted text.
 func (m *model) applyAction(a action) {
+	if m.viewOnly {
+		return
+	}
 	switch a.kind {
+	case "group":
+		for _, child := range a.group {
+			m.applyAction(child)
+		}
+		return
 	case "insert":
-		line := m.lines[a.y]
-		m.lines[a.y] = line[:a.x] + a.text + line[a.x:]
-		m.cursorY = a.y
-		m.cursorX = a.x + len(a.text)
-		m.invalidateCache(a.y)
+		m.shiftViews(a)
+		m.buf.Insert(a.off, a.text)
+		m.cursorY, m.cursorX = m.buf.Position(a.off + len(a.text))
 	case "delete":
-		line := m.lines[a.y]
-		end := a.x + len(a.text)
-		m.lines[a.y] = line[:a.x] + line[end:]
-		m.cursorY = a.y
-		m.cursorX = a.x
-		m.invalidateCache(a.y)
-	case "split":
-		line := m.lines[a.y]
-		left := line[:a.x]
-		right := line[a.x:]
-		m.lines = append(m.lines[:a.y+1], append([]string{right}, m.lines[a.y+1:]...)...)
-		m.lines[a.y] = left
-		m.cursorY = a.y + 1
-		m.cursorX = 0
-		m.invalidateCache(a.y)
-		m.invalidateCache(a.y + 1)
-	case "join":
-		left := m.lines[a.y-1]
-		right := m.lines[a.y]
-		m.lines[a.y-1] = left + right
-		m.lines = append(m.lines[:a.y], m.lines[a.y+1:]...)
-		m.cursorY = a.y - 1
-		m.cursorX = len(left)
-		m.invalidateCache(a.y - 1)
+		m.shiftViews(a)
+		m.buf.Delete(a.off, len(a.text))
+		m.cursorY, m.cursorX = m.buf.Position(a.off)
+	}
+	if strings.Contains(a.text, "\n") {
+		// Every line below the edit has moved.
+		m.cachedTokens = make(map[int][]chroma.Token)
+	} else {
+		m.invalidateCache(m.cursorY)
 	}
 	m.updateLineNumWidth()
 	m.modified = true
+	m.changes++
 }
 
+func (m *model) cursorOffset() int {
+	return m.buf.Offset(m.cursorY, m.cursorX)
+}
+
+// Update handles msg, then the changes to files on disk that were put off
+// while a prompt was open, if it has been closed.
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	next, cmd := m.update(msg)
+	m = next.(model)
+	if m.mode != "edit" {
+		return m, cmd
+	}
+	cmds := []tea.Cmd{cmd}
+	for _, d := range m.docs {
+		if d.diskPending {
+			var c tea.Cmd
+			m, c = m.compareDisk(d)
+			cmds = append(cmds, c)
+		}
+	}
+	return m, tea.Batch(cmds...)
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.WindowSizeMsg:
-		m.width = msg.Width
-		m.height = msg.Height - 4 // header + footer 2 + status/err
+		m.screenWidth = msg.Width
+		m.screenHeight = msg.Height - 4 // header + footer 2 + status/err
+		m.layoutViews()
 		titleStyle = titleStyle.Width(msg.Width)
+		if m.cursorY < m.offsetY || m.cursorY >= m.offsetY+m.height {
+			m.centerCursor()
+		}
+		m.hexScroll()
 		return m, nil
+	case swapTickMsg:
+		return m.updateSwap()
+	case swapWrittenMsg:
+		return m.swapWritten(msg)
+	case diskChangedMsg:
+		return m.diskUpdated(msg)
 	case tea.KeyMsg:
+		if m.mode == "swap" || m.mode == "swaplocked" {
+			return m.updateSwapPrompt(msg)
+		}
+		if m.mode == "diff" {
+			return m.updateDiff(msg)
+		}
+		if m.mode == "diskchanged" {
+			return m.updateDiskChanged(msg)
+		}
+		if m.mode == "format" {
+			return m.updateFormat(msg)
+		}
+		if m.mode == "encoding" {
+			return m.updateEncoding(msg)
+		}
 		if m.mode == "prompt" {
 			switch strings.ToLower(msg.String()) {
 			case "y":
-				err := m.save()
-				if err != nil {
-					m.err = err
-					m.mode = "edit"
-					return m, nil
-				}
-				m.quitting = true
-				return m, tea.Quit
+				return m.writeOut(true)
 			case "n":
-				m.quitting = true
-				return m, tea.Quit
+				return m.exitFrom(m.docIndex() + 1)
 			case "ctrl+c", "esc":
 				m.mode = "edit"
 				return m, nil
 			}
 			return m, nil
 		}
+		if m.mode == "buffers" {
+			return m.updateBufferList(msg)
+		}
+		if m.mode == "readfile" || m.mode == "readcmd" {
+			return m.updateRead(msg)
+		}
+		if m.mode == "writeout" {
+			return m.updateWriteOut(msg)
+		}
+		if m.mode == "overwrite" {
+			return m.updateOverwrite(msg)
+		}
+		if m.mode == "hexsearch" {
+			return m.updateHexSearch(msg)
+		}
+		if m.mode == "hexgoto" {
+			return m.updateHexGoto(msg)
+		}
+		if m.pager && m.mode == "edit" {
+			return m.updatePager(msg)
+		}
+		if m.hex && m.mode == "edit" {
+			return m.updateHex(msg)
+		}
+		if m.mode == "replace" || m.mode == "replacewith" || m.mode == "replaceconfirm" {
+			return m.updateReplace(msg)
+		}
+		if m.mode == "goto" {
+			return m.updateGoto(msg)
+		}
 		if m.mode == "search" {
-			var cmd tea.Cmd
-			m.searchInput, cmd = m.searchInput.Update(msg)
-			if msg.String() == "enter" {
-				phrase := m.searchInput.Value()
-				m.mode = "edit"
-				found := false
-				startY := m.cursorY
-				startX := m.cursorX
-				if startX > 0 {
-					idx := strings.Index(m.lines[startY][startX:], phrase)
-					if idx >= 0 {
-						m.cursorX = startX + idx
-						found = true
-					} else {
-						startY++
-						startX = 0
-					}
-				} else {
-					startY++
-					startX = 0
-				}
-				if !found {
-					for i := startY; i < len(m.lines); i++ {
-						idx := strings.Index(m.lines[i], phrase)
-						if idx >= 0 {
-							m.cursorY = i
-							m.cursorX = idx
-							found = true
-							break
-						}
-					}
-				}
-				if !found {
-					for i := 0; i < m.cursorY; i++ {
-						idx := strings.Index(m.lines[i], phrase)
-						if idx >= 0 {
-							m.cursorY = i
-							m.cursorX = idx
-							found = true
-							break
-						}
-					}
-				}
-				if !found {
-					m.status = "Not found: " + phrase
-					m.cursorY = startY
-					m.cursorX = startX
-					return m, m.clearStatusAfter(3 * time.Second)
-				}
-				m.adjustScroll()
-				return m, nil
-			}
-			if msg.String() == "esc" {
-				m.mode = "edit"
-				return m, nil
-			}
-			return m, cmd
+			return m.updateSearch(msg)
+		}
+		if m.mode == "undotree" {
+			return m.updateUndoTree(msg)
+		}
+		if m.mode == "travel" {
+			return m.updateTravel(msg)
+		}
+		switch msg.Type {
+		case tea.KeyRunes, tea.KeySpace, tea.KeyBackspace, tea.KeyDelete:
+			// Typing and deleting may extend the last undo step.
+		default:
+			m.breakUndo()
 		}
 		switch {
 		case key.Matches(msg, saveKey):
-			err := m.save()
-			if err != nil {
-				m.err = err
-			} else {
-				m.modified = false
-				m.status = "File saved"
-				return m, m.clearStatusAfter(3 * time.Second)
-			}
+			m.startWriteOut(false)
 			return m, nil
 		case key.Matches(msg, exitKey):
-			if !m.modified {
-				m.quitting = true
-				return m, tea.Quit
-			}
-			m.mode = "prompt"
+			return m.exit()
+		case key.Matches(msg, nextBufKey):
+			return m.cycleBuffer(1)
+		case key.Matches(msg, prevBufKey):
+			return m.cycleBuffer(-1)
+		case key.Matches(msg, bufListKey):
+			m.startBufferList()
 			return m, nil
+		case key.Matches(msg, readKey):
+			m.startRead()
+			return m, nil
+		case key.Matches(msg, splitKey), key.Matches(msg, vsplitKey):
+			m.split(key.Matches(msg, vsplitKey))
+			return m, nil
+		case key.Matches(msg, focusKey):
+			return m.cycleFocus()
+		case key.Matches(msg, closeKey):
+			return m.closeView()
 		case key.Matches(msg, posKey):
-			m.status = fmt.Sprintf("Line %d/%d Col %d", m.cursorY+1, len(m.lines), m.cursorX+1)
+			m.status = fmt.Sprintf("Line %d/%d Col %d", m.cursorY+1, m.buf.LineCount(), m.cursorX+1)
 			return m, m.clearStatusAfter(3 * time.Second)
 		case key.Matches(msg, undoKey):
-			if len(m.undoStack) > 0 {
-				a := m.undoStack[len(m.undoStack)-1]
-				m.undoStack = m.undoStack[:len(m.undoStack)-1]
-				inv := inverse(a)
-				m.applyAction(inv)
-				m.redoStack = append(m.redoStack, a)
-			}
+			m.undo()
+			m.adjustScroll()
 			return m, nil
 		case key.Matches(msg, redoKey):
-			if len(m.redoStack) > 0 {
-				a := m.redoStack[len(m.redoStack)-1]
-				m.redoStack = m.redoStack[:len(m.redoStack)-1]
-				inv := inverse(a)
-				m.applyAction(inv)
-				m.undoStack = append(m.undoStack, a)
+			m.redo()
+			m.adjustScroll()
+			return m, nil
+		case key.Matches(msg, formatKey):
+			if !m.readOnly() {
+				m.mode = "format"
 			}
 			return m, nil
+		case key.Matches(msg, encodeKey):
+			m.startEncoding()
+			return m, nil
+		case key.Matches(msg, treeKey):
+			m.startUndoTree()
+			return m, nil
+		case key.Matches(msg, travelKey):
+			m.mode = "travel"
+			m.travelInput.Focus()
+			return m, nil
 		case key.Matches(msg, searchKey):
 			m.mode = "search"
-			m.searchInput.Focus()
+			m.startSearch()
+			return m, nil
+		case key.Matches(msg, nextKey):
+			return m.findNext(false)
+		case key.Matches(msg, prevKey):
+			return m.findNext(true)
+		case key.Matches(msg, replaceKey):
+			if !m.readOnly() {
+				m.mode = "replace"
+				m.startSearch()
+			}
+			return m, nil
+		case key.Matches(msg, gotoKey):
+			m.mode = "goto"
+			m.gotoInput.Focus()
+			return m, nil
+		case key.Matches(msg, markKey):
+			return m, m.toggleMark()
+		case key.Matches(msg, indentKey):
+			m.indentLines(false)
+			m.adjustScroll()
+			return m, nil
+		case key.Matches(msg, outdentKey):
+			m.indentLines(true)
+			m.adjustScroll()
+			return m, nil
+		case key.Matches(msg, upperKey):
+			m.changeCase(true)
+			m.adjustScroll()
+			return m, nil
+		case key.Matches(msg, lowerKey):
+			m.changeCase(false)
+			m.adjustScroll()
 			return m, nil
 		case key.Matches(msg, copyKey):
-			if err := clipboard.WriteAll(m.lines[m.cursorY] + "\n"); err != nil {
+			if start, end, ok := m.selection(); ok {
+				if err := m.copySelection(start, end); err != nil {
+					m.err = err
+					return m, nil
+				}
+				m.clearMark()
+				m.status = "Selection copied"
+				return m, m.clearStatusAfter(3 * time.Second)
+			}
+			if err := clipboard.WriteAll(m.buf.Line(m.cursorY) + "\n"); err != nil {
 				m.err = err
 			} else {
 				m.status = "Line copied"
@@ -354,144 +596,167 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			return m, nil
 		case key.Matches(msg, cutKey):
-			line := m.lines[m.cursorY]
+			if m.readOnly() {
+				return m, nil
+			}
+			if start, end, ok := m.selection(); ok {
+				if err := m.copySelection(start, end); err != nil {
+					m.err = err
+					return m, nil
+				}
+				m.deleteSelection(start, end)
+				m.adjustScroll()
+				return m, nil
+			}
+			line := m.buf.Line(m.cursorY)
 			if err := clipboard.WriteAll(line + "\n"); err != nil {
 				m.err = err
 				return m, nil
 			}
-			m.lines = append(m.lines[:m.cursorY], m.lines[m.cursorY+1:]...)
-			if m.cursorY >= len(m.lines) && len(m.lines) > 0 {
-				m.cursorY = len(m.lines) - 1
+			y := m.cursorY
+			start, end := m.buf.LineStart(y), m.buf.LineEnd(y)+1
+			if end > m.buf.Len() && start > 0 {
+				// The last line has no newline of its own; take the one before it.
+				start--
 			}
-			m.cursorX = 0
-			m.modified = true
-			m.updateLineNumWidth()
-			m.invalidateCache(m.cursorY)
-			// For simplicity, undo for cut/paste not implemented fully
+			m.edit(action{kind: "delete", off: start, text: m.buf.Slice(start, end)})
+			m.cursorY = min(y, m.buf.LineCount()-1)
+			m.cursorX = bytePosFromVisual(m.buf.Line(m.cursorY), m.targetVisualCol)
+			m.setUndoCursor()
+			m.adjustScroll()
 			return m, nil
 		case key.Matches(msg, pasteKey):
+			if m.readOnly() {
+				return m, nil
+			}
 			text, err := clipboard.ReadAll()
 			if err != nil {
 				m.err = err
 				return m, nil
 			}
-			pasteLines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
-			m.lines = append(m.lines[:m.cursorY], append(pasteLines, m.lines[m.cursorY:]...)...)
-			m.cursorY += len(pasteLines)
-			m.cursorX = 0
-			m.modified = true
-			m.updateLineNumWidth()
-			for i := 0; i < len(pasteLines); i++ {
-				m.invalidateCache(m.cursorY - len(pasteLines) + i)
+			if text == "" {
+				return m, nil
+			}
+			if !strings.HasSuffix(text, "\n") {
+				// Part of a line: insert it at the cursor.
+				m.insertString(text)
+				m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+				m.adjustScroll()
+				return m, nil
 			}
+			// Whole lines go above the cursor line, which keeps its column.
+			x := m.cursorX
+			m.edit(action{kind: "insert", off: m.buf.LineStart(m.cursorY), text: text})
+			m.cursorX = x
+			m.setUndoCursor()
+			m.adjustScroll()
 			return m, nil
 		}
+		if t, ok := shiftedKeys[msg.Type]; ok {
+			if !m.markSet {
+				m.setMark()
+				m.softMark = true
+			}
+			msg = tea.KeyMsg{Type: t}
+		} else if m.softMark && isMovementKey(msg.Type) {
+			m.clearMark()
+		}
 		// Editing keys
 		switch msg.Type {
 		case tea.KeyUp:
 			if m.cursorY > 0 {
 				m.cursorY--
-				m.cursorX = bytePosFromVisual(m.lines[m.cursorY], m.targetVisualCol)
+				m.cursorX = bytePosFromVisual(m.buf.Line(m.cursorY), m.targetVisualCol)
 			}
 		case tea.KeyDown:
-			if m.cursorY < len(m.lines)-1 {
+			if m.cursorY < m.buf.LineCount()-1 {
 				m.cursorY++
-				m.cursorX = bytePosFromVisual(m.lines[m.cursorY], m.targetVisualCol)
+				m.cursorX = bytePosFromVisual(m.buf.Line(m.cursorY), m.targetVisualCol)
 			}
 		case tea.KeyLeft:
-			line := m.lines[m.cursorY]
+			line := m.buf.Line(m.cursorY)
 			if m.cursorX > 0 {
-				m.cursorX = utf8Prev(line, m.cursorX)
+				m.cursorX = buffer.PrevRune(line, m.cursorX)
 			} else if m.cursorY > 0 {
 				m.cursorY--
-				m.cursorX = len(m.lines[m.cursorY])
+				m.cursorX = m.buf.LineLen(m.cursorY)
 			}
-			m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 		case tea.KeyRight:
-			line := m.lines[m.cursorY]
+			line := m.buf.Line(m.cursorY)
 			if m.cursorX < len(line) {
-				m.cursorX = utf8Next(line, m.cursorX)
-			} else if m.cursorY < len(m.lines)-1 {
+				m.cursorX = buffer.NextRune(line, m.cursorX)
+			} else if m.cursorY < m.buf.LineCount()-1 {
 				m.cursorY++
 				m.cursorX = 0
 			}
-			m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 		case tea.KeyHome, tea.KeyCtrlA:
 			m.cursorX = 0
-			m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			m.targetVisualCol = 0
 		case tea.KeyEnd, tea.KeyCtrlE:
-			m.cursorX = len(m.lines[m.cursorY])
-			m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			line := m.buf.Line(m.cursorY)
+			m.cursorX = len(line)
+			m.targetVisualCol = visualCol(line, m.cursorX)
 		case tea.KeyBackspace:
-			if m.cursorX > 0 {
-				line := m.lines[m.cursorY]
-				prev := utf8Prev(line, m.cursorX)
-				deleted := line[prev:m.cursorX]
-				m.lines[m.cursorY] = line[:prev] + line[m.cursorX:]
-				m.cursorX = prev
-				m.invalidateCache(m.cursorY)
-				m.pushUndo(action{kind: "insert", y: m.cursorY, x: m.cursorX, text: deleted})
-				m.modified = true
-				m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			off := m.cursorOffset()
+			if start, end, ok := m.selection(); ok {
+				m.deleteSelection(start, end)
+			} else if m.cursorX > 0 {
+				line := m.buf.Line(m.cursorY)
+				prev := buffer.PrevRune(line, m.cursorX)
+				m.edit(action{kind: "delete", off: off - (m.cursorX - prev), text: line[prev:m.cursorX]})
+				m.targetVisualCol = visualCol(line, m.cursorX)
 			} else if m.cursorY > 0 {
-				prevLen := len(m.lines[m.cursorY-1])
-				m.lines[m.cursorY-1] += m.lines[m.cursorY]
-				m.lines = append(m.lines[:m.cursorY], m.lines[m.cursorY+1:]...)
-				m.invalidateCache(m.cursorY - 1)
-				m.pushUndo(action{kind: "split", y: m.cursorY, x: prevLen, text: ""})
-				m.cursorY--
-				m.cursorX = prevLen
-				m.modified = true
-				m.updateLineNumWidth()
-				m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+				m.edit(action{kind: "delete", off: off - 1, text: "\n"})
+				m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 			}
 		case tea.KeyDelete:
-			line := m.lines[m.cursorY]
-			if m.cursorX < len(line) {
-				next := utf8Next(line, m.cursorX)
-				deleted := line[m.cursorX:next]
-				m.lines[m.cursorY] = line[:m.cursorX] + line[next:]
-				m.invalidateCache(m.cursorY)
-				m.pushUndo(action{kind: "insert", y: m.cursorY, x: m.cursorX, text: deleted})
-				m.modified = true
-				m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
-			} else if m.cursorY < len(m.lines)-1 {
-				nextLine := m.lines[m.cursorY+1]
-				m.lines[m.cursorY] += nextLine
-				m.lines = append(m.lines[:m.cursorY+1], m.lines[m.cursorY+2:]...)
-				m.invalidateCache(m.cursorY)
-				m.pushUndo(action{kind: "split", y: m.cursorY, x: len(m.lines[m.cursorY]) - len(nextLine), text: ""})
-				m.modified = true
-				m.updateLineNumWidth()
-				m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			line := m.buf.Line(m.cursorY)
+			if start, end, ok := m.selection(); ok {
+				m.deleteSelection(start, end)
+			} else if m.cursorX < len(line) {
+				next := buffer.NextRune(line, m.cursorX)
+				m.edit(action{kind: "delete", off: m.cursorOffset(), text: line[m.cursorX:next]})
+			} else if m.cursorY < m.buf.LineCount()-1 {
+				m.edit(action{kind: "delete", off: m.cursorOffset(), text: "\n"})
 			}
+			m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 		case tea.KeyEnter:
-			oldY := m.cursorY
-			oldX := m.cursorX
-			line := m.lines[oldY]
-			left := line[:oldX]
-			right := line[oldX:]
-			m.lines[oldY] = left
-			m.lines = append(m.lines[:oldY+1], append([]string{right}, m.lines[oldY+1:]...)...)
-			// Auto-indent
+			// Auto-indent, undone together with the newline
+			left := m.buf.Line(m.cursorY)[:m.cursorX]
 			indent := leadingWhitespace(left)
-			m.lines[oldY+1] = indent + m.lines[oldY+1]
-			m.cursorY = oldY + 1
-			m.cursorX = len(indent)
-			m.invalidateCache(oldY)
-			m.invalidateCache(oldY + 1)
-			m.pushUndo(action{kind: "join", y: oldY + 1, x: len(left), text: ""})
-			m.modified = true
-			m.updateLineNumWidth()
-			m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			m.beginGroup()
+			if indent != "" && indent == left {
+				// Don't leave the indentation of a blank line behind.
+				m.edit(action{kind: "delete", off: m.buf.LineStart(m.cursorY), text: indent})
+			}
+			m.edit(action{kind: "insert", off: m.cursorOffset(), text: "\n"})
+			if indent != "" {
+				m.edit(action{kind: "insert", off: m.cursorOffset(), text: indent})
+			}
+			m.endGroup()
+			m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 		case tea.KeyTab:
+			if _, _, ok := m.selection(); ok {
+				m.indentLines(false)
+				break
+			}
 			m.insertString("\t")
-			m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+		case tea.KeyShiftTab:
+			m.indentLines(true)
 		default:
-			s := msg.String()
-			if len(s) == 1 && unicode.IsGraphic(rune(s[0])) {
-				m.insertString(s)
-				m.targetVisualCol = visualCol(m.lines[m.cursorY], m.cursorX)
+			if text := typedText(msg); text != "" {
+				if msg.Paste {
+					m.breakUndo()
+				}
+				m.insertString(text)
+				if msg.Paste {
+					// A paste is a step of its own.
+					m.breakUndo()
+				}
+				m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
 			}
 		}
 	case clearStatusMsg:
@@ -515,13 +780,37 @@ func leadingWhitespace(s string) string {
 }
 
 func (m *model) insertString(s string) {
-	oldX := m.cursorX
-	line := m.lines[m.cursorY]
-	m.lines[m.cursorY] = line[:oldX] + s + line[oldX:]
-	m.cursorX += len(s)
-	m.invalidateCache(m.cursorY)
-	m.pushUndo(action{kind: "delete", y: m.cursorY, x: oldX, text: s})
-	m.modified = true
+	m.edit(action{kind: "insert", off: m.cursorOffset(), text: s})
+}
+
+// typedText returns the text typed by a key: a space, or the runes of a
+// KeyRunes message, which may be several at once from an input method or a
+// paste, less any control characters. Alt with a character beyond ASCII,
+// as some terminals send for the Option key, types the character; Alt with
+// anything else is a command and types nothing.
+func typedText(msg tea.KeyMsg) string {
+	switch {
+	case msg.Type == tea.KeySpace && !msg.Alt:
+		return " "
+	case msg.Type != tea.KeyRunes:
+		return ""
+	}
+	text := string(msg.Runes)
+	if msg.Paste {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		text = strings.ReplaceAll(text, "\r", "\n")
+	}
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case msg.Alt && r < utf8.RuneSelf:
+			return ""
+		case unicode.IsGraphic(r), unicode.Is(unicode.Join_Control, r),
+			msg.Paste && (r == '\n' || r == '\t'):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
 func (m *model) adjustScroll() {
@@ -534,7 +823,7 @@ func (m *model) adjustScroll() {
 	}
 	// Horizontal
 	textWidth := m.width - m.lineNumWidth - 1
-	cursorVisual := visualCol(m.lines[m.cursorY], m.cursorX)
+	cursorVisual := visualCol(m.buf.Line(m.cursorY), m.cursorX)
 	if cursorVisual < m.offsetX {
 		m.offsetX = cursorVisual
 	}
@@ -550,27 +839,92 @@ func (m model) clearStatusAfter(d time.Duration) tea.Cmd {
 	}
 }
 
+// capitalize returns s with its first letter in upper case, as errors are
+// shown on the status line.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[n:]
+}
+
 func (m model) View() string {
 	if m.quitting {
 		return "Goodbye!\n"
 	}
-	header := titleStyle.Render("hedit - " + m.filename)
+	name := "hedit"
+	if m.pager {
+		name = "hview"
+	}
+	title := name + " - " + m.displayName()
+	if len(m.docs) > 1 {
+		title = fmt.Sprintf("%s [%d/%d] - %s", name, m.docIndex()+1, len(m.docs), m.displayName())
+	}
 	if m.modified {
-		header = titleStyle.Render("hedit - " + m.filename + " *")
+		title += " *"
+	}
+	if m.viewOnly {
+		title += " [Read Only]"
+	}
+	label := m.format.label()
+	if m.hex {
+		label = m.hexLabel()
+	}
+	header := titleStyle.Render(m.titleLine(title, label))
+	body := m.renderLayout()
+	if m.mode == "undotree" {
+		body = m.renderUndoTree()
+	} else if m.mode == "diff" {
+		body = m.renderDiff()
+	} else if m.mode == "buffers" {
+		body = m.renderBufferList()
 	}
-	body := m.renderBody()
 	footer := m.renderFooter()
 	var statusStr string
 	if m.status != "" {
 		statusStr = helpStyle.Render(m.status)
 	} else if m.err != nil {
-		statusStr = errorStyle.Render(m.err.Error())
+		statusStr = errorStyle.Render(capitalize(m.err.Error()))
 	}
 	if m.mode == "prompt" {
-		prompt := "File modified. Save changes? (Y)es (N)o ^C Cancel"
-		statusStr = promptStyle.Render(prompt)
+		statusStr = promptStyle.Render(m.exitPrompt())
 	} else if m.mode == "search" {
-		statusStr = promptStyle.Render("Search: " + m.searchInput.View())
+		statusStr = promptStyle.Render("Search" + m.searchOpts.label() + ": " + m.searchInput.View() + m.matchCountLabel())
+	} else if m.mode == "replace" {
+		statusStr = promptStyle.Render("Search (to replace)" + m.searchOpts.label() + ": " + m.searchInput.View())
+	} else if m.mode == "replacewith" {
+		statusStr = promptStyle.Render("Replace with: " + m.replaceInput.View())
+	} else if m.mode == "replaceconfirm" {
+		statusStr = promptStyle.Render("Replace this instance? (Y)es (N)o (A)ll ^C Cancel")
+	} else if m.mode == "goto" {
+		statusStr = promptStyle.Render("Enter line number, column number (^Y First Line ^V Last Line): " + m.gotoInput.View())
+	} else if m.mode == "undotree" {
+		statusStr = promptStyle.Render("Undo tree: Up/Down Select  Enter Restore  ^C Cancel")
+	} else if m.mode == "swap" || m.mode == "swaplocked" {
+		statusStr = promptStyle.Render(m.swapPrompt())
+	} else if m.mode == "format" {
+		statusStr = promptStyle.Render("Line endings: (U)nix LF (D)OS CRLF (M)ac CR  Toggle: (B)OM (F)inal newline ^C Cancel")
+	} else if m.mode == "hexsearch" {
+		statusStr = promptStyle.Render("Search for bytes (hex or \"text\"): " + m.searchInput.View())
+	} else if m.mode == "hexgoto" {
+		statusStr = promptStyle.Render("Enter offset (0x for hex, +/- relative; ^Y Start ^V End): " + m.gotoInput.View())
+	} else if m.mode == "encoding" {
+		statusStr = promptStyle.Render("Save with encoding: " + m.encodingInput.View())
+	} else if m.mode == "diskchanged" {
+		statusStr = promptStyle.Render(m.diskChangedPrompt())
+	} else if m.mode == "diff" {
+		statusStr = promptStyle.Render("Differences: Up/Down Scroll  Esc Back")
+	} else if m.mode == "writeout" {
+		statusStr = promptStyle.Render(m.writeOutPrompt())
+	} else if m.mode == "overwrite" {
+		statusStr = promptStyle.Render(m.overwritePrompt())
+	} else if m.mode == "readfile" || m.mode == "readcmd" {
+		statusStr = promptStyle.Render(m.readPrompt())
+	} else if m.mode == "buffers" {
+		statusStr = promptStyle.Render("Buffers: Up/Down Select  Enter Switch  ^C Cancel")
+	} else if m.mode == "travel" {
+		statusStr = promptStyle.Render("Go back by time or changes (+ to go forward): " + m.travelInput.View())
 	}
 	return lipgloss.JoinVertical(
 		lipgloss.Left,
@@ -581,9 +935,18 @@ func (m model) View() string {
 	)
 }
 
+// titleLine puts right at the right-hand end of the title bar.
+func (m model) titleLine(left, right string) string {
+	pad := m.screenWidth - 2 - runewidth.StringWidth(left) - runewidth.StringWidth(right)
+	if pad < 1 {
+		return left
+	}
+	return left + strings.Repeat(" ", pad) + right
+}
+
 func (m model) renderBody() string {
 	renderedLines := []string{}
-	maxLines := min(m.offsetY+m.height, len(m.lines))
+	maxLines := min(m.offsetY+m.height, m.buf.LineCount())
 	for i := m.offsetY; i < maxLines; i++ {
 		num := lineNumberStyle.Width(m.lineNumWidth).Align(lipgloss.Right).Render(fmt.Sprintf("%*d", m.lineNumWidth-1, i+1))
 		highlighted := m.highlightLine(i)
@@ -597,12 +960,19 @@ func (m model) renderBody() string {
 }
 
 func (m model) highlightLine(y int) string {
-	raw := m.lines[y]
+	raw := m.buf.Line(y)
 	textWidth := m.width - m.lineNumWidth - 1
 	offsetX := m.offsetX
+	if !utf8.ValidString(raw) {
+		// The lexer would turn invalid bytes into U+FFFD and put the
+		// tokens out of step with the line.
+		return m.fallbackHighlight(raw, y, offsetX, textWidth)
+	}
 	tokens, ok := m.cachedTokens[y]
 	if !ok {
-		iterator, err := m.lexer.Tokenise(nil, raw+"\n")
+		// By default chroma turns a "\r" into "\n", which would cut the
+		// line short there.
+		iterator, err := m.lexer.Tokenise(&chroma.TokeniseOptions{State: "root"}, raw+"\n")
 		if err != nil {
 			// fallback
 			return m.fallbackHighlight(raw, y, offsetX, textWidth)
@@ -614,8 +984,11 @@ func (m model) highlightLine(y int) string {
 		m.cachedTokens[y] = tokens
 	}
 	highlighted := ""
-	pos := 0 // visual pos from line start
+	pos := 0  // visual pos from line start
+	base := 0 // byte index of the token in the line
 	cursorVisual := visualCol(raw, m.cursorX)
+	matches := m.lineMatches(raw)
+	selected := m.lineSelection(y, raw)
 	for _, token := range tokens {
 		entry := m.theme.Get(token.Type)
 		ls := lipgloss.NewStyle()
@@ -637,7 +1010,7 @@ func (m model) highlightLine(y int) string {
 		value := token.Value
 		for j := 0; j < len(value); {
 			r, size := utf8.DecodeRuneInString(value[j:])
-			if r == '\n' || r == utf8.RuneError {
+			if r == '\n' {
 				break
 			}
 			w := visualWidth(r, pos)
@@ -662,26 +1035,36 @@ func (m model) highlightLine(y int) string {
 			char := string(r)
 			if r == '\t' {
 				char = strings.Repeat(" ", w)
+			} else if buffer.IsControl(r) {
+				// Written raw, a stray "\r" would move the terminal's cursor.
+				char = invalidStyle.Render(buffer.Caret(r)[skip : skip+w])
+			}
+			style := ls
+			if inMatch(selected, base+j) {
+				style = m.selectionStyle.Inherit(ls)
+			} else if inMatch(matches, base+j) {
+				style = m.matchStyle
 			}
-			isCursor := (y == m.cursorY) && (pos == cursorVisual)
+			isCursor := !m.unfocused && y == m.cursorY && pos == cursorVisual
 			if isCursor {
-				highlighted += cursorStyle.Render(ls.Render(char))
+				highlighted += cursorStyle.Render(style.Render(char))
 			} else {
-				highlighted += ls.Render(char)
+				highlighted += style.Render(char)
 			}
 			pos += w
 			j += size
-			if pos >= offsetX + textWidth {
+			if pos >= offsetX+textWidth {
 				break
 			}
 		}
-		if pos >= offsetX + textWidth {
+		if pos >= offsetX+textWidth {
 			break
 		}
+		base += len(value)
 	}
 	// Cursor at end
 	lineVisualWidth := visualCol(raw, len(raw))
-	if y == m.cursorY && m.cursorX == len(raw) {
+	if !m.unfocused && y == m.cursorY && m.cursorX == len(raw) {
 		if lineVisualWidth >= offsetX && lineVisualWidth < offsetX+textWidth {
 			highlighted += cursorStyle.Render(" ")
 		}
@@ -698,12 +1081,11 @@ func (m model) fallbackHighlight(raw string, y int, offsetX, textWidth int) stri
 	highlighted := ""
 	pos := 0
 	cursorVisual := visualCol(raw, m.cursorX)
+	matches := m.lineMatches(raw)
+	selected := m.lineSelection(y, raw)
 	for j := 0; j < len(raw); {
 		r, size := utf8.DecodeRuneInString(raw[j:])
-		if r == utf8.RuneError {
-			break
-		}
-		w := visualWidth(r, pos)
+		w := charWidth(r, size, pos)
 		skip := 0
 		if pos < offsetX {
 			skip = offsetX - pos
@@ -725,8 +1107,19 @@ func (m model) fallbackHighlight(raw string, y int, offsetX, textWidth int) stri
 		char := string(r)
 		if r == '\t' {
 			char = strings.Repeat(" ", w)
+		} else if r == utf8.RuneError && size == 1 {
+			// Show the byte as <XX>, cut to what is visible.
+			char = fmt.Sprintf("<%02X>", raw[j])
+			char = invalidStyle.Render(char[skip : skip+w])
+		} else if buffer.IsControl(r) {
+			char = invalidStyle.Render(buffer.Caret(r)[skip : skip+w])
 		}
-		isCursor := (y == m.cursorY) && (pos == cursorVisual)
+		if inMatch(selected, j) {
+			char = m.selectionStyle.Render(char)
+		} else if inMatch(matches, j) {
+			char = m.matchStyle.Render(char)
+		}
+		isCursor := !m.unfocused && y == m.cursorY && pos == cursorVisual
 		if isCursor {
 			highlighted += cursorStyle.Render(char)
 		} else {
@@ -734,12 +1127,12 @@ func (m model) fallbackHighlight(raw string, y int, offsetX, textWidth int) stri
 		}
 		pos += w
 		j += size
-		if pos >= offsetX + textWidth {
+		if pos >= offsetX+textWidth {
 			break
 		}
 	}
 	lineVisualWidth := visualCol(raw, len(raw))
-	if y == m.cursorY && m.cursorX == len(raw) {
+	if !m.unfocused && y == m.cursorY && m.cursorX == len(raw) {
 		if lineVisualWidth >= offsetX && lineVisualWidth < offsetX+textWidth {
 			highlighted += cursorStyle.Render(" ")
 		}
@@ -752,6 +1145,9 @@ func (m model) fallbackHighlight(raw string, y int, offsetX, textWidth int) stri
 }
 
 func (m model) renderFooter() string {
+	if m.pager {
+		return m.pagerFooter()
+	}
 	line1 := "^G Get Help ^O Write Out ^W Where Is ^K Cut ^P Copy ^U Paste ^C Cur Pos ^Z Undo ^Y Redo"
 	line2 := "^X Exit      ^R Read File ^\\ Replace ^J Justify ^T To Spell ^_ Go To Line"
 	return footerStyle.Render(line1 + "\n" + line2)
@@ -764,79 +1160,122 @@ func min(a, b int) int {
 	return b
 }
 
+func charWidth(r rune, size, col int) int {
+	return buffer.CharWidth(r, size, col, tabWidth)
+}
+
 func visualWidth(r rune, col int) int {
-	if r == '\t' {
-		return tabWidth - (col % tabWidth)
-	}
-	return runewidth.RuneWidth(r)
+	return buffer.VisualWidth(r, col, tabWidth)
 }
 
 func visualCol(line string, bytePos int) int {
-	col := 0
-	j := 0
-	for j < bytePos {
-		r, size := utf8.DecodeRuneInString(line[j:])
-		if size == 0 {
-			break
-		}
-		col += visualWidth(r, col)
-		j += size
-	}
-	return col
+	return buffer.VisualCol(line, bytePos, tabWidth)
 }
 
 func bytePosFromVisual(line string, target int) int {
-	col := 0
-	j := 0
-	for j < len(line) {
-		r, size := utf8.DecodeRuneInString(line[j:])
-		if size == 0 {
-			break
-		}
-		w := visualWidth(r, col)
-		if col+w > target {
-			break
-		}
-		col += w
-		j += size
-	}
-	return j
-}
-
-func utf8Prev(line string, pos int) int {
-	if pos <= 0 {
-		return 0
-	}
-	pos--
-	for pos > 0 && !utf8.RuneStart(line[pos]) {
-		pos--
-	}
-	return pos
-}
-
-func utf8Next(line string, pos int) int {
-	if pos >= len(line) {
-		return pos
-	}
-	_, size := utf8.DecodeRuneInString(line[pos:])
-	if size == 0 {
-		return len(line)
-	}
-	return pos + size
+	return buffer.ByteFromVisual(line, target, tabWidth)
 }
 
 func main() {
 	themeName := flag.String("theme", "monokai", "Chroma theme to use")
+	backupMode := flag.String("backup", "simple", "backups to keep when saving: off, simple (file.bak), numbered (file.~N~) or dir")
+	backupDir := flag.String("backup-dir", "", "directory for -backup=dir (default $XDG_STATE_HOME/hedit/backup)")
+	backupKeep := flag.Int("backups", 10, "numbered backups to keep per file, 0 for all")
+	encoding := flag.String("encoding", "", "character encoding of the file, such as latin1 or utf-16le (default: detect)")
+	hexFlag := flag.Bool("hex", false, "edit the file as hex bytes (the default for binary files)")
+	watch := flag.Bool("watch", false, "watch the file and reload it when changed by another program")
+	pipe := flag.Bool("pipe", false, "edit standard input (or the first file) and write the result to standard output on exit")
+	var view bool
+	flag.BoolVar(&view, "v", false, "view the files without changing them")
+	flag.BoolVar(&view, "view", false, "same as -v")
 	flag.Parse()
+	pager := filepath.Base(os.Args[0]) == "hview"
+	view = view || pager
+	mode, err := parseBackupMode(*backupMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *encoding != "" {
+		if _, _, err := lookupEncoding(*encoding); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if *backupDir == "" && mode == "dir" {
+		dir, err := stateDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		*backupDir = filepath.Join(dir, "backup")
+	}
 	args := flag.Args()
+	if len(args) == 0 && *pipe {
+		args = []string{"-"}
+	}
 	if len(args) == 0 {
-		fmt.Println("Usage: hedit <filename>")
+		fmt.Fprintln(os.Stderr, "Usage: hedit [+LINE[,COL]] <filename>[:LINE[:COL]] ... (- for standard input)")
 		os.Exit(1)
 	}
-	filename := args[0]
-	p := tea.NewProgram(initialModel(filename, *themeName), tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
-		fmt.Println("Error running program:", err)
+	var files []fileArg
+	var names []string
+	for _, f := range parseFileArgs(args) {
+		if !slices.Contains(names, f.name) {
+			files = append(files, f)
+			names = append(names, f.name)
+		}
+	}
+	m := initialModel(names, *themeName, openOptions{encoding: *encoding, hex: *hexFlag, view: view})
+	m.backup = backupPolicy{mode: mode, dir: *backupDir, keep: *backupKeep}
+	m.pipe = *pipe
+	m.pager = pager
+	cur := m.document
+	for i, f := range files {
+		m.document = m.docs[i]
+		if *watch && f.name != "-" {
+			if m.watch, m.unwatch, err = watchFile(f.name); err != nil {
+				m.err = fmt.Errorf("cannot watch %s: %w", f.name, err)
+			}
+		}
+		if f.line > 0 {
+			m.gotoPos(f.line-1, max(f.col-1, 0))
+		}
+	}
+	m.document = cur
+	opts := []tea.ProgramOption{tea.WithAltScreen()}
+	if slices.Contains(names, "-") {
+		// Standard input was the text; keys come from the terminal.
+		opts = append(opts, tea.WithInputTTY())
+	}
+	if *pipe {
+		// Standard output is for the text; draw on the terminal.
+		tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot open the terminal:", err)
+			os.Exit(1)
+		}
+		defer tty.Close()
+		lipgloss.DefaultRenderer().SetOutput(termenv.NewOutput(tty))
+		opts = append(opts, tea.WithOutput(tty))
+	}
+	p := tea.NewProgram(m, opts...)
+	final, err := p.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error running program:", err)
 		os.Exit(1)
 	}
+	final.(model).removeSwap()
+	if *pipe {
+		d := final.(model).docs[0]
+		data, err := encodeText(d.buf.String(), d.format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ^R inserts a file at the cursor; ^X at its prompt switches to running a
+// shell command and inserting what it prints instead.
+
+var readKey = key.NewBinding(key.WithKeys("ctrl+r"))
+
+// startRead opens the prompt for the file to insert.
+func (m *model) startRead() {
+	if m.readOnly() {
+		return
+	}
+	m.mode = "readfile"
+	m.readInput.SetValue("")
+	m.readInput.Focus()
+}
+
+func (m model) updateRead(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.completions = nil
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "ctrl+x":
+		if m.mode == "readfile" {
+			m.mode = "readcmd"
+		} else {
+			m.mode = "readfile"
+		}
+		return m, nil
+	case "tab":
+		if m.mode == "readfile" {
+			m.completePath()
+		}
+		return m, nil
+	case "enter":
+		mode, input := m.mode, m.readInput.Value()
+		m.mode = "edit"
+		if input == "" {
+			return m, nil
+		}
+		var text string
+		var err error
+		if mode == "readcmd" {
+			text, err = m.readCommand(input)
+		} else {
+			text, err = m.readFile(expandHome(input))
+		}
+		if text != "" {
+			m.insertRead(text)
+		}
+		if err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
+		m.status = fmt.Sprintf("Read %d lines", countLines(text))
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	var cmd tea.Cmd
+	m.readInput, cmd = m.readInput.Update(msg)
+	return m, cmd
+}
+
+// readFile returns the text of a file, decoded as it would be on opening
+// it. In hex mode the bytes are taken as they are.
+func (m *model) readFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if m.hex {
+		return string(data), nil
+	}
+	text, f, err := decodeText(data, "")
+	if err != nil && !errors.Is(err, errLossy) {
+		return "", err
+	}
+	if f.finalEOL {
+		text += "\n"
+	}
+	return text, nil
+}
+
+// readCommand runs a shell command and returns its output, along with any
+// error from running it.
+func (m *model) readCommand(command string) (string, error) {
+	out, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		err = fmt.Errorf("%s: %w", command, err)
+	}
+	if m.hex {
+		return string(out), err
+	}
+	return strings.ReplaceAll(string(out), "\r\n", "\n"), err
+}
+
+// insertRead inserts text at the cursor as one undo step.
+func (m *model) insertRead(text string) {
+	m.breakUndo()
+	if m.hex {
+		off := m.hexCursor
+		m.hexEdit(off+len(text), action{kind: "insert", off: off, text: text})
+		m.hexScroll()
+		return
+	}
+	m.insertString(text)
+	m.breakUndo()
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+	m.adjustScroll()
+}
+
+// completePath completes the path typed at the prompt as far as the files
+// it could name agree, and lists them if there are several.
+func (m *model) completePath() {
+	input := m.readInput.Value()
+	dir, prefix := filepath.Split(input)
+	entries, err := os.ReadDir(expandHome(dir))
+	if err != nil && dir == "" {
+		entries, err = os.ReadDir(".")
+	}
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(prefix, ".")) {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		} else if e.Type()&os.ModeSymlink != 0 {
+			if info, err := os.Stat(filepath.Join(expandHome(dir), name)); err == nil && info.IsDir() {
+				name += "/"
+			}
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	common := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	m.readInput.SetValue(dir + common)
+	m.readInput.CursorEnd()
+	if len(names) > 1 {
+		m.completions = names
+	}
+}
+
+// countLines counts the lines in text, the last of which need not end
+// with a newline.
+func countLines(text string) int {
+	if text == "" {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(text, "\n"), "\n") + 1
+}
+
+// expandHome replaces a leading "~/" with the home directory.
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// readPrompt is the prompt for the file or command to insert.
+func (m model) readPrompt() string {
+	if m.mode == "readcmd" {
+		return "Command to execute (^X Read File): " + m.readInput.View()
+	}
+	prompt := "File to insert (Tab Complete ^X Execute Command): " + m.readInput.View()
+	if m.completions != nil {
+		prompt = strings.Join(m.completions, "  ") + "\n" + prompt
+	}
+	return prompt
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// replaceState tracks an interactive replace between the first match and
+// the point where the search has wrapped back around to where it started.
+type replaceState struct {
+	matcher    *matcher
+	with       string
+	stop       int  // offset the search started from
+	wrapped    bool // the search has passed the end of the buffer
+	count      int
+	start, end int    // the current match
+	text       string // its replacement
+}
+
+func (m model) updateReplace(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		if m.mode == "replaceconfirm" {
+			return m.finishReplace()
+		}
+		m.mode = "edit"
+		return m, nil
+	}
+	switch m.mode {
+	case "replace":
+		if m.searchOpts.toggle(msg.String()) {
+			return m, nil
+		}
+		var cmd tea.Cmd
+		m.searchInput, cmd = m.searchInput.Update(msg)
+		if msg.String() == "enter" {
+			if m.searchInput.Value() == "" {
+				m.searchInput.SetValue(m.lastSearch)
+			}
+			if m.searchInput.Value() == "" {
+				m.mode = "edit"
+				return m, nil
+			}
+			m.mode = "replacewith"
+			m.replaceInput.Focus()
+			return m, nil
+		}
+		return m, cmd
+	case "replacewith":
+		var cmd tea.Cmd
+		m.replaceInput, cmd = m.replaceInput.Update(msg)
+		if msg.String() == "enter" {
+			phrase := m.searchInput.Value()
+			mt, err := newMatcher(phrase, m.searchOpts)
+			if err != nil {
+				m.mode = "edit"
+				m.err = err
+				return m, nil
+			}
+			m.lastSearch = phrase
+			off := m.cursorOffset()
+			m.replace = replaceState{
+				matcher: mt,
+				with:    m.replaceInput.Value(),
+				stop:    off,
+			}
+			m.beginGroup()
+			if !m.nextReplaceMatch(off) {
+				m.endGroup()
+				m.mode = "edit"
+				m.status = "Not found: " + phrase
+				return m, m.clearStatusAfter(3 * time.Second)
+			}
+			m.mode = "replaceconfirm"
+			return m, nil
+		}
+		return m, cmd
+	}
+	switch strings.ToLower(msg.String()) {
+	case "y":
+		m.replaceCurrent()
+	case "n":
+		if !m.nextReplaceMatch(m.replace.end + emptyStep(m.replace.start, m.replace.end)) {
+			return m.finishReplace()
+		}
+	case "a":
+		for m.replaceCurrent() {
+		}
+	default:
+		return m, nil
+	}
+	if m.mode == "edit" {
+		return m.finishReplace()
+	}
+	m.adjustScroll()
+	return m, nil
+}
+
+// emptyStep returns 1 for an empty match so that the search moves past it.
+func emptyStep(start, end int) int {
+	if start == end {
+		return 1
+	}
+	return 0
+}
+
+// replaceCurrent replaces the match at the cursor and moves to the next
+// one. It reports false and leaves replace mode when there are none left.
+func (m *model) replaceCurrent() bool {
+	r := &m.replace
+	if r.end > r.start {
+		m.edit(action{kind: "delete", off: r.start, text: m.buf.Slice(r.start, r.end)})
+	}
+	if r.text != "" {
+		m.edit(action{kind: "insert", off: r.start, text: r.text})
+	}
+	if r.wrapped {
+		r.stop += len(r.text) - (r.end - r.start)
+	}
+	r.count++
+	if !m.nextReplaceMatch(r.start + len(r.text) + emptyStep(r.start, r.end)) {
+		m.mode = "edit"
+		return false
+	}
+	return true
+}
+
+// nextReplaceMatch moves the cursor to the next match at or after off,
+// wrapping once around the end of the buffer.
+func (m *model) nextReplaceMatch(off int) bool {
+	r := &m.replace
+	y, x := m.buf.Position(off)
+	if off > m.buf.Len() {
+		x++ // past the end of the buffer
+	}
+	found, wrapped, ok := m.find(r.matcher, y, x, false)
+	if !ok || (wrapped && r.wrapped) {
+		return false
+	}
+	r.wrapped = r.wrapped || wrapped
+	lineStart := m.buf.LineStart(found.y)
+	r.start, r.end = lineStart+found.loc[0], lineStart+found.loc[1]
+	if r.wrapped && r.end > r.stop {
+		return false
+	}
+	r.text = r.matcher.expand(m.buf.Line(found.y), found.loc, r.with)
+	m.cursorY, m.cursorX = found.y, found.loc[0]
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+	return true
+}
+
+func (m model) finishReplace() (tea.Model, tea.Cmd) {
+	m.endGroup()
+	m.mode = "edit"
+	if m.replace.count == 1 {
+		m.status = "Replaced 1 occurrence"
+	} else {
+		m.status = fmt.Sprintf("Replaced %d occurrences", m.replace.count)
+	}
+	m.adjustScroll()
+	return m, m.clearStatusAfter(3 * time.Second)
+}
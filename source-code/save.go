@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic replaces the file at path with data. The data is written
+// to a temporary file in the same directory, synced and renamed over the
+// original, so that a crash leaves either the old or the new content but
+// never a mix. Symlinks are followed, and the new file keeps the mode,
+// owner and extended attributes of the old one where possible; a file that
+// did not exist gets the permissions the umask allows. On failure the
+// original is left untouched.
+func writeFileAtomic(path string, data []byte) error {
+	target, err := resolveLinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	switch {
+	case err == nil && !info.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", target)
+	case errors.Is(err, fs.ErrNotExist):
+		info = nil
+	case err != nil:
+		return err
+	}
+	return replaceFile(target, data, info, target)
+}
+
+// replaceFile atomically puts data at name, replacing whatever is there,
+// a symlink included, rather than writing through it. The new file gets
+// the mode, owner and extended attributes of the file from, which info
+// describes, or if info is nil the permissions the umask allows.
+func replaceFile(name string, data []byte, info fs.FileInfo, from string) (err error) {
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	perm := fs.FileMode(0666)
+	if info != nil {
+		perm = 0600 // until it has the mode of from
+	}
+	f, err := createTemp(dir, base, perm)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", name, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if info != nil {
+		copyAttrs(f, info, from)
+		// Chmod after copyAttrs, as changing the owner clears setuid bits.
+		mode := info.Mode().Perm() | info.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)
+		if err = f.Chmod(mode); err != nil {
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	// Make the rename itself durable. Not every file system can sync a
+	// directory, so failure here is not reported.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// createTemp creates a new file for writing next to base in dir, as
+// os.CreateTemp does, but with the permissions perm less the umask.
+func createTemp(dir, base string, perm fs.FileMode) (*os.File, error) {
+	for range 100 {
+		name := filepath.Join(dir, "."+base+".hedit-"+strconv.FormatUint(rand.Uint64(), 36))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+	return nil, fmt.Errorf("cannot create a temporary file in %s", dir)
+}
+
+// resolveLinks follows the symlinks at path, so that saving through a link
+// writes the file it points to. A link to a file that does not exist yet
+// resolves to where that file would be created.
+func resolveLinks(path string) (string, error) {
+	for range 255 {
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return path, nil
+		}
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+}
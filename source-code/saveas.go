@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ^O asks for the name to write to, starting from the file's own. Writing
+// to another name saves the buffer as that file from then on, unless only
+// the selection is written or the buffer is appended or prepended to the
+// file, which leave the buffer as it was. Those are refused for the file
+// being edited, which would then no longer hold the buffer.
+
+var errPartialWrite = errors.New("cannot write part of the buffer over its own file")
+
+// startWriteOut opens the prompt for the name to write to. With quit set,
+// the exit goes on once the file is saved.
+func (m *model) startWriteOut(quit bool) {
+	if m.readOnly() {
+		return
+	}
+	m.mode = "writeout"
+	m.writeMode = ""
+	m.quitAfterSave = quit
+	m.writeInput.SetValue(m.filename)
+	m.writeInput.CursorEnd()
+	m.writeInput.Focus()
+}
+
+func (m model) updateWriteOut(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "alt+a":
+		m.writeMode = toggle(m.writeMode, "append")
+		return m, nil
+	case "alt+p":
+		m.writeMode = toggle(m.writeMode, "prepend")
+		return m, nil
+	case "enter":
+		path := expandHome(strings.TrimSpace(m.writeInput.Value()))
+		if path == "" {
+			m.mode = "edit"
+			return m, nil
+		}
+		_, _, selected := m.selection()
+		if path == m.filename && m.writeMode == "" && !selected {
+			return m.writeOut(m.quitAfterSave)
+		}
+		if (selected || m.writeMode != "") && m.isOwnFile(path) {
+			m.mode = "edit"
+			m.err = errPartialWrite
+			return m, nil
+		}
+		m.writePath = path
+		if _, err := os.Stat(path); err == nil && m.writeMode == "" {
+			m.mode = "overwrite"
+			return m, nil
+		}
+		return m.writeTo()
+	}
+	var cmd tea.Cmd
+	m.writeInput, cmd = m.writeInput.Update(msg)
+	return m, cmd
+}
+
+// isOwnFile reports whether path is the file of the buffer, by whatever
+// name.
+func (m *model) isOwnFile(path string) bool {
+	if m.filename == "" {
+		return false
+	}
+	if path == m.filename {
+		return true
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	own, err := os.Stat(m.filename)
+	return err == nil && os.SameFile(info, own)
+}
+
+// toggle returns mode, unless it is already set, in which case it is turned
+// off.
+func toggle(cur, mode string) string {
+	if cur == mode {
+		return ""
+	}
+	return mode
+}
+
+// updateOverwrite handles the question asked before writing over another
+// file.
+func (m model) updateOverwrite(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch strings.ToLower(msg.String()) {
+	case "y":
+		return m.writeTo()
+	case "n", "esc", "ctrl+c":
+		m.mode = "writeout"
+	}
+	return m, nil
+}
+
+// writeTo writes to m.writePath as chosen at the prompt.
+func (m model) writeTo() (tea.Model, tea.Cmd) {
+	m.mode = "edit"
+	path := m.writePath
+	start, end, selected := m.selection()
+	if !selected && m.writeMode == "" {
+		watch, err := m.saveAs(path)
+		if err != nil {
+			m.err = err
+			return m, nil
+		}
+		if m.quitAfterSave {
+			return m.exitFrom(m.docIndex() + 1)
+		}
+		if m.err != nil {
+			return m, watch // saved, but with a warning to show
+		}
+		m.status = "Wrote " + path
+		return m, tea.Batch(watch, m.clearStatusAfter(3*time.Second))
+	}
+	text, f := m.buf.String(), m.format
+	if selected {
+		text, f.finalEOL = m.buf.Slice(start, end), false
+	}
+	if m.writeMode == "append" {
+		f.bom = false
+	}
+	data, err := encodeText(text, f)
+	if err != nil {
+		m.err = err
+		return m, nil
+	}
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		m.err = err
+		return m, nil
+	}
+	verb := "Wrote"
+	switch m.writeMode {
+	case "append":
+		data, verb = append(old, data...), "Appended"
+	case "prepend":
+		data, verb = append(data, old...), "Prepended"
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		m.err = err
+		return m, nil
+	}
+	m.err = nil
+	m.status = fmt.Sprintf("%s %d lines to %s", verb, countLines(text), path)
+	return m, m.clearStatusAfter(3 * time.Second)
+}
+
+// saveAs saves the buffer as path, which is its file from then on. The
+// swap file moves with it, unless another hedit is editing path, and so
+// does the watcher. The command it returns waits for the new watcher. If
+// the file cannot be written, nothing changes.
+func (m *model) saveAs(path string) (tea.Cmd, error) {
+	prev := *m.document
+	m.filename = path
+	m.disk = diskState{}
+	m.lexer = lexers.Match(path)
+	if m.lexer == nil {
+		m.lexer = lexers.Fallback
+	}
+	m.cachedTokens = make(map[int][]chroma.Token)
+	if err := m.save(); err != nil {
+		*m.document = prev
+		return nil, err
+	}
+	m.modified = false
+	if m.swapPath != "" && m.staleSwap == nil {
+		dropSwap(m.swapPath)
+	}
+	m.swapPath, m.staleSwap = "", nil
+	if abs, swapPath, err := statePath(path, "swap"); err == nil {
+		if old, err := readSwap(swapPath); err == nil && old.Path == abs && old.inUse() {
+			m.err = fmt.Errorf("%s is being edited by another hedit; no swap file is kept", path)
+		} else {
+			m.swapPath = swapPath
+			m.swapChanges = -1 // written on the next tick
+		}
+	}
+	if m.watch == nil {
+		return nil, nil
+	}
+	m.unwatch()
+	var err error
+	if m.watch, m.unwatch, err = watchFile(path); err != nil {
+		m.err = fmt.Errorf("cannot watch %s: %w", path, err)
+		return nil, nil
+	}
+	return waitForDisk(m.document), nil
+}
+
+// overwritePrompt asks before writing over another file.
+func (m model) overwritePrompt() string {
+	if _, _, selected := m.selection(); selected {
+		return "File \"" + m.writePath + "\" exists, OVERWRITE it with only the selection? (Y)es (N)o"
+	}
+	return "File \"" + m.writePath + "\" exists, OVERWRITE? (Y)es (N)o"
+}
+
+// writeOutPrompt is the prompt for the name to write to.
+func (m model) writeOutPrompt() string {
+	_, _, selected := m.selection()
+	var what string
+	switch {
+	case m.writeMode == "append" && selected:
+		what = "Append Selection to File"
+	case m.writeMode == "append":
+		what = "File Name to Append to"
+	case m.writeMode == "prepend" && selected:
+		what = "Prepend Selection to File"
+	case m.writeMode == "prepend":
+		what = "File Name to Prepend to"
+	case selected:
+		what = "Write Selection to File"
+	default:
+		what = "File Name to Write"
+	}
+	return what + " (M-A Append M-P Prepend ^C Cancel): " + m.writeInput.View()
+}
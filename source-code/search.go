@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// maxCountBytes is the largest buffer in which incremental search counts
+// every match on each keystroke.
+const maxCountBytes = 16 << 20
+
+// searchOptions are toggled from inside the search and replace prompts and
+// remembered for the next search.
+type searchOptions struct {
+	caseSensitive bool
+	regex         bool
+	wholeWord     bool
+	backward      bool
+}
+
+// toggle flips the option bound to key k and reports whether there was one.
+func (o *searchOptions) toggle(k string) bool {
+	switch k {
+	case "alt+c":
+		o.caseSensitive = !o.caseSensitive
+	case "alt+r":
+		o.regex = !o.regex
+	case "alt+w":
+		o.wholeWord = !o.wholeWord
+	case "alt+b":
+		o.backward = !o.backward
+	default:
+		return false
+	}
+	return true
+}
+
+// label describes the options that are switched on, for the prompt.
+func (o searchOptions) label() string {
+	s := ""
+	if o.caseSensitive {
+		s += " [Case Sensitive]"
+	}
+	if o.regex {
+		s += " [Regexp]"
+	}
+	if o.wholeWord {
+		s += " [Whole Word]"
+	}
+	if o.backward {
+		s += " [Backwards]"
+	}
+	return s
+}
+
+// matcher finds a search phrase within single lines. Literal phrases are
+// compiled to a quoted regexp so that both kinds share one code path.
+type matcher struct {
+	re        *regexp.Regexp
+	regex     bool
+	wholeWord bool
+}
+
+func newMatcher(phrase string, opts searchOptions) (*matcher, error) {
+	expr := phrase
+	if !opts.regex {
+		expr = regexp.QuoteMeta(phrase)
+	}
+	if !opts.caseSensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &matcher{re: re, regex: opts.regex, wholeWord: opts.wholeWord}, nil
+}
+
+// all returns the submatch indexes of every match in line.
+func (mt *matcher) all(line string) [][]int {
+	locs := mt.re.FindAllStringSubmatchIndex(line, -1)
+	if !mt.wholeWord {
+		return locs
+	}
+	words := locs[:0]
+	for _, loc := range locs {
+		before, _ := utf8.DecodeLastRuneInString(line[:loc[0]])
+		after, _ := utf8.DecodeRuneInString(line[loc[1]:])
+		if !isWordRune(before) && !isWordRune(after) {
+			words = append(words, loc)
+		}
+	}
+	return words
+}
+
+// expand returns the replacement for the match loc in line. For regular
+// expressions, $1 or ${name} in template refer to capture groups.
+func (mt *matcher) expand(line string, loc []int, template string) string {
+	if !mt.regex {
+		return template
+	}
+	return string(mt.re.ExpandString(nil, template, line, loc))
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// match is a match of a matcher on line y.
+type match struct {
+	y   int
+	loc []int // submatch byte indexes within the line
+}
+
+// find looks for the next match from line y, byte x, wrapping around the
+// buffer once. Forward matches start at or after x, backward ones before it.
+// wrapped reports whether the search passed the end (or start) of the buffer.
+func (m *model) find(mt *matcher, y, x int, backward bool) (found match, wrapped, ok bool) {
+	n := m.buf.LineCount()
+	for i := 0; i <= n; i++ {
+		ly := y + i
+		if backward {
+			ly = y - i
+		}
+		wrapped = ly < 0 || ly >= n
+		ly = (ly%n + n) % n
+		locs := mt.all(m.buf.Line(ly))
+		for j := range locs {
+			loc := locs[j]
+			if backward {
+				loc = locs[len(locs)-1-j]
+			}
+			before := loc[0] < x
+			if i == 0 && before != backward {
+				continue // on the wrong side of the cursor
+			}
+			if i == n && before == backward {
+				break // back where the search started
+			}
+			return match{y: ly, loc: loc}, wrapped, true
+		}
+	}
+	return match{}, false, false
+}
+
+// searchNext moves the cursor to the next match of phrase after the cursor,
+// or before it when searching backwards.
+func (m model) searchNext(phrase string, opts searchOptions) (tea.Model, tea.Cmd) {
+	mt, err := newMatcher(phrase, opts)
+	if err != nil {
+		m.err = err
+		return m, nil
+	}
+	x := m.cursorX
+	if !opts.backward {
+		x++ // skip the match under the cursor
+	}
+	found, wrapped, ok := m.find(mt, m.cursorY, x, opts.backward)
+	if !ok {
+		m.status = "Not found: " + phrase
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	m.cursorY, m.cursorX = found.y, found.loc[0]
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+	m.adjustScroll()
+	if wrapped {
+		m.status = "Search Wrapped"
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	return m, nil
+}
+
+// viewPos is the cursor and scroll position, saved so that a cancelled
+// search can put them back.
+type viewPos struct {
+	cursorY, cursorX int
+	offsetY, offsetX int
+}
+
+func (m *model) position() viewPos {
+	return viewPos{m.cursorY, m.cursorX, m.offsetY, m.offsetX}
+}
+
+func (m *model) restoreViewPos(v viewPos) {
+	m.cursorY, m.cursorX = v.cursorY, v.cursorX
+	m.offsetY, m.offsetX = v.offsetY, v.offsetX
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+}
+
+// startSearch opens the search prompt, empty, with the last phrase as the
+// placeholder that Enter falls back to.
+func (m *model) startSearch() {
+	m.searchOrigin = m.position()
+	m.searchFound = false
+	m.matchIndex, m.matchCount = 0, 0
+	m.searchInput.SetValue("")
+	m.searchInput.Placeholder = "Search for..."
+	if m.lastSearch != "" {
+		m.searchInput.Placeholder = m.lastSearch
+	}
+	m.searchInput.Focus()
+}
+
+// incrementalSearch moves the cursor to the match of the phrase typed so
+// far that is nearest to where the search started, and counts the matches.
+func (m *model) incrementalSearch() {
+	m.restoreViewPos(m.searchOrigin)
+	m.highlight, m.searchFound = nil, false
+	m.matchIndex, m.matchCount = 0, 0
+	phrase := m.searchInput.Value()
+	if phrase == "" {
+		return
+	}
+	mt, err := newMatcher(phrase, m.searchOpts)
+	if err != nil {
+		return // most likely a regexp that is still being typed
+	}
+	m.highlight = mt
+	o := m.searchOrigin
+	found, _, ok := m.find(mt, o.cursorY, o.cursorX, m.searchOpts.backward)
+	if !ok {
+		return
+	}
+	m.searchFound = true
+	m.cursorY, m.cursorX = found.y, found.loc[0]
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+	m.adjustScroll()
+	if m.buf.Len() <= maxCountBytes {
+		m.matchIndex, m.matchCount = m.countMatches(mt, found)
+	}
+}
+
+// countMatches returns the number of matches in the buffer and the
+// position of cur among them.
+func (m *model) countMatches(mt *matcher, cur match) (index, count int) {
+	for y := 0; y < m.buf.LineCount(); y++ {
+		for _, loc := range mt.all(m.buf.Line(y)) {
+			count++
+			if y < cur.y || (y == cur.y && loc[0] <= cur.loc[0]) {
+				index = count
+			}
+		}
+	}
+	return index, count
+}
+
+func (m model) matchCountLabel() string {
+	switch {
+	case m.searchInput.Value() == "" || m.highlight == nil:
+		return ""
+	case !m.searchFound:
+		return "  [not found]"
+	case m.matchCount == 0:
+		return ""
+	case m.matchCount == 1:
+		return "  [1 of 1 match]"
+	}
+	return fmt.Sprintf("  [%d of %d matches]", m.matchIndex, m.matchCount)
+}
+
+// lineMatches returns the matches in line to highlight, if any.
+func (m model) lineMatches(line string) [][]int {
+	if m.highlight == nil {
+		return nil
+	}
+	return m.highlight.all(line)
+}
+
+func inMatch(locs [][]int, i int) bool {
+	for _, loc := range locs {
+		if i >= loc[0] && i < loc[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchStyleFor returns the style of highlighted matches: the theme's
+// background colour on its string colour, which every theme sets and which
+// stands out from ordinary text.
+func matchStyleFor(theme *chroma.Style) lipgloss.Style {
+	style := lipgloss.NewStyle()
+	if hl := theme.Get(chroma.LiteralString).Colour; hl.IsSet() {
+		style = style.Background(lipgloss.Color(hl.String()))
+	} else {
+		style = style.Reverse(true)
+	}
+	if bg := theme.Get(chroma.Background).Background; bg.IsSet() {
+		style = style.Foreground(lipgloss.Color(bg.String()))
+	}
+	return style
+}
+
+func (m model) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.searchOpts.toggle(msg.String()) {
+		m.incrementalSearch()
+		return m, nil
+	}
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		m.highlight = nil
+		m.restoreViewPos(m.searchOrigin)
+		return m, nil
+	case "enter":
+		m.mode = "edit"
+		m.highlight = nil
+		phrase := m.searchInput.Value()
+		if phrase == "" {
+			if m.lastSearch == "" {
+				return m, nil
+			}
+			return m.searchNext(m.lastSearch, m.searchOpts)
+		}
+		m.lastSearch = phrase
+		if _, err := newMatcher(phrase, m.searchOpts); err != nil {
+			m.err = err
+			return m, nil
+		}
+		if !m.searchFound {
+			m.status = "Not found: " + phrase
+			return m, m.clearStatusAfter(3 * time.Second)
+		}
+		if m.matchCount > 0 {
+			m.status = fmt.Sprintf("Match %d of %d", m.matchIndex, m.matchCount)
+			return m, m.clearStatusAfter(3 * time.Second)
+		}
+		return m, nil
+	}
+	before := m.searchInput.Value()
+	var cmd tea.Cmd
+	m.searchInput, cmd = m.searchInput.Update(msg)
+	if m.searchInput.Value() != before {
+		m.incrementalSearch()
+	}
+	return m, cmd
+}
+
+// findNext repeats the last search forwards or backwards.
+func (m model) findNext(backward bool) (tea.Model, tea.Cmd) {
+	if m.lastSearch == "" {
+		m.status = "No current search pattern"
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	opts := m.searchOpts
+	opts.backward = backward
+	return m.searchNext(m.lastSearch, opts)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/atotto/clipboard"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// shiftedKeys maps the keys that extend the selection to the movement they
+// make.
+var shiftedKeys = map[tea.KeyType]tea.KeyType{
+	tea.KeyShiftUp:    tea.KeyUp,
+	tea.KeyShiftDown:  tea.KeyDown,
+	tea.KeyShiftLeft:  tea.KeyLeft,
+	tea.KeyShiftRight: tea.KeyRight,
+	tea.KeyShiftHome:  tea.KeyHome,
+	tea.KeyShiftEnd:   tea.KeyEnd,
+}
+
+func isMovementKey(t tea.KeyType) bool {
+	switch t {
+	case tea.KeyUp, tea.KeyDown, tea.KeyLeft, tea.KeyRight,
+		tea.KeyHome, tea.KeyEnd, tea.KeyCtrlA, tea.KeyCtrlE:
+		return true
+	}
+	return false
+}
+
+// toggleMark sets the mark at the cursor, or unsets it.
+func (m *model) toggleMark() tea.Cmd {
+	if m.markSet {
+		m.clearMark()
+		m.status = "Mark Unset"
+	} else {
+		m.setMark()
+		m.status = "Mark Set"
+	}
+	return m.clearStatusAfter(3 * time.Second)
+}
+
+func (m *model) setMark() {
+	m.markSet = true
+	m.softMark = false
+	m.markY, m.markX = m.cursorY, m.cursorX
+}
+
+func (m *model) clearMark() {
+	m.markSet = false
+	m.softMark = false
+}
+
+// selection returns the byte offsets of the text between the mark and the
+// cursor. ok is false when the mark is not set or nothing is selected.
+func (m *model) selection() (start, end int, ok bool) {
+	if !m.markSet {
+		return 0, 0, false
+	}
+	start = m.buf.Offset(m.markY, m.markX)
+	end = m.cursorOffset()
+	if start > end {
+		start, end = end, start
+	}
+	return start, end, start < end
+}
+
+// lineSelection returns the selected part of line y as a byte range, in the
+// form used for search matches.
+func (m model) lineSelection(y int, line string) [][]int {
+	if !m.markSet {
+		return nil
+	}
+	startY, startX, endY, endX := m.markY, m.markX, m.cursorY, m.cursorX
+	if startY > endY || (startY == endY && startX > endX) {
+		startY, startX, endY, endX = endY, endX, startY, startX
+	}
+	if y < startY || y > endY {
+		return nil
+	}
+	if y > startY {
+		startX = 0
+	}
+	if y < endY {
+		endX = len(line)
+	}
+	return [][]int{{startX, endX}}
+}
+
+// selectionStyleFor returns the style of selected text: the theme's line
+// highlight colour behind the syntax colours, or reverse video for themes
+// without one.
+func selectionStyleFor(theme *chroma.Style) lipgloss.Style {
+	if bg := theme.Get(chroma.LineHighlight).Background; bg.IsSet() {
+		return lipgloss.NewStyle().Background(lipgloss.Color(bg.String()))
+	}
+	return lipgloss.NewStyle().Reverse(true)
+}
+
+// copySelection puts the selected text on the clipboard.
+func (m *model) copySelection(start, end int) error {
+	return clipboard.WriteAll(m.buf.Slice(start, end))
+}
+
+// deleteSelection removes the selected text as one undoable action.
+func (m *model) deleteSelection(start, end int) {
+	m.edit(action{kind: "delete", off: start, text: m.buf.Slice(start, end)})
+	m.clearMark()
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+}
+
+// selectedLines returns the lines touched by the selection, or the cursor
+// line without one. A selection ending at the start of a line does not
+// include that line.
+func (m *model) selectedLines() (first, last int) {
+	start, end, ok := m.selection()
+	if !ok {
+		return m.cursorY, m.cursorY
+	}
+	first, _ = m.buf.Position(start)
+	last, endX := m.buf.Position(end)
+	if endX == 0 && last > first {
+		last--
+	}
+	return first, last
+}
+
+// indentLines indents, or unindents, the selected lines by one tab as one
+// undoable action. The selection is widened to the whole lines.
+func (m *model) indentLines(unindent bool) {
+	first, last := m.selectedLines()
+	cursorY, cursorX := m.cursorY, m.cursorX
+	m.beginGroup()
+	for y := first; y <= last; y++ {
+		line := m.buf.Line(y)
+		if !unindent {
+			if line != "" {
+				m.edit(action{kind: "insert", off: m.buf.LineStart(y), text: "\t"})
+				if y == cursorY {
+					cursorX++
+				}
+			}
+			continue
+		}
+		n := 0
+		if strings.HasPrefix(line, "\t") {
+			n = 1
+		} else {
+			for n < len(line) && n < tabWidth && line[n] == ' ' {
+				n++
+			}
+		}
+		if n > 0 {
+			m.edit(action{kind: "delete", off: m.buf.LineStart(y), text: line[:n]})
+			if y == cursorY {
+				cursorX = max(0, cursorX-n)
+			}
+		}
+	}
+	if m.markSet {
+		m.markY, m.markX = first, 0
+		m.cursorY, m.cursorX = last, m.buf.LineLen(last)
+	} else {
+		m.cursorY, m.cursorX = cursorY, cursorX
+	}
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+	m.endGroup()
+}
+
+// changeCase upper- or lowercases the selection, or the word at the cursor
+// without one, as one undoable action.
+func (m *model) changeCase(upper bool) {
+	start, end, ok := m.selection()
+	if !ok {
+		start, end = m.wordAt(m.cursorY, m.cursorX)
+	}
+	text := m.buf.Slice(start, end)
+	changed := strings.ToLower(text)
+	if upper {
+		changed = strings.ToUpper(text)
+	}
+	if changed == text {
+		return
+	}
+	m.beginGroup()
+	m.edit(action{kind: "delete", off: start, text: text})
+	m.edit(action{kind: "insert", off: start, text: changed})
+	m.endGroup()
+	if ok {
+		m.markY, m.markX = m.buf.Position(start)
+	}
+	m.targetVisualCol = visualCol(m.buf.Line(m.cursorY), m.cursorX)
+}
+
+// wordAt returns the offsets of the word at or just after line y, byte x.
+func (m *model) wordAt(y, x int) (start, end int) {
+	line := m.buf.Line(y)
+	for x < len(line) {
+		r, size := utf8.DecodeRuneInString(line[x:])
+		if isWordRune(r) {
+			break
+		}
+		x += size
+	}
+	s, e := x, x
+	for s > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:s])
+		if !isWordRune(r) {
+			break
+		}
+		s -= size
+	}
+	for e < len(line) {
+		r, size := utf8.DecodeRuneInString(line[e:])
+		if !isWordRune(r) {
+			break
+		}
+		e += size
+	}
+	lineStart := m.buf.LineStart(y)
+	return lineStart + s, lineStart + e
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"hedit/buffer"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// While a file is open, its unsaved changes are written every swapInterval
+// to a swap file under $XDG_STATE_HOME/hedit/swap, so that they can be
+// recovered if hedit or the terminal dies. The swap file also marks the
+// file as being edited: a second hedit finding it warns before editing the
+// same file. It is removed when hedit exits normally.
+const swapInterval = 2 * time.Second
+
+// swapFile is the header of a swap file, which the buffer, if Modified,
+// follows as it is.
+type swapFile struct {
+	Path     string
+	PID      int
+	Host     string
+	Time     time.Time
+	Modified bool
+	Content  string // read from after the header
+}
+
+// Swap files are written in the background from a snapshot of the buffer,
+// so that a large file does not hold up editing. The writes are numbered,
+// and one overtaken by a later write to the same file is skipped.
+var (
+	swapMu      sync.Mutex
+	swapWritten = map[string]int{} // the last write to each swap file, under swapMu
+	swapSeq     int
+	swapWrites  sync.WaitGroup
+)
+
+type swapTickMsg struct{}
+
+// swapWrittenMsg reports a finished write of the swap file of doc.
+type swapWrittenMsg struct {
+	doc *document
+	err error
+}
+
+func swapTick() tea.Cmd {
+	return tea.Tick(swapInterval, func(time.Time) tea.Msg {
+		return swapTickMsg{}
+	})
+}
+
+func readSwap(path string) (*swapFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	var s swapFile
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Modified && s.Content == "" {
+		s.Content = string(data[len(data)-r.Len():])
+	}
+	return &s, nil
+}
+
+// inUse reports whether the hedit that wrote s may still be running.
+// Processes on other hosts cannot be checked, so they are assumed to be.
+func (s *swapFile) inUse() bool {
+	host, _ := os.Hostname()
+	if s.Host != host {
+		return true
+	}
+	return s.PID != os.Getpid() && processAlive(s.PID)
+}
+
+// openSwap looks for a swap file left for the file. If another hedit is
+// editing it, or one died leaving unsaved changes, the user is asked what to
+// do, by nextSwapPrompt; otherwise the swap file is taken over.
+func (m *model) openSwap() {
+	if m.filename == "" {
+		return
+	}
+	abs, path, err := statePath(m.filename, "swap")
+	if err != nil {
+		return
+	}
+	if old, err := readSwap(path); err == nil && old.Path == abs {
+		if old.inUse() {
+			m.staleSwap = old
+			return
+		}
+		if old.Modified && !m.buf.Equal(old.Content) {
+			m.staleSwap = old
+			m.swapPath = path
+			return
+		}
+	}
+	m.swapPath = path
+	m.swapChanges = -1 // written when the program starts
+}
+
+// nextSwapPrompt switches to the first buffer with a swap file not yet dealt
+// with and asks about it. It reports whether there was one.
+func (m *model) nextSwapPrompt() bool {
+	for _, d := range m.docs {
+		if d.staleSwap == nil {
+			continue
+		}
+		m.document = d
+		m.mode = "swap"
+		if d.swapPath == "" {
+			m.mode = "swaplocked" // another hedit has it
+		}
+		return true
+	}
+	return false
+}
+
+// writeSwap starts recording the state of the buffer in the swap file. The
+// command it returns reports when that is done.
+func (m *model) writeSwap() tea.Cmd {
+	abs, _, err := statePath(m.filename, "swap")
+	if err != nil {
+		return nil
+	}
+	host, _ := os.Hostname()
+	s := swapFile{Path: abs, PID: os.Getpid(), Host: host, Time: time.Now(), Modified: m.modified}
+	var content *buffer.Buffer
+	if m.modified {
+		content = m.buf.Snapshot()
+	}
+	m.swapChanges, m.swapModified = m.changes, m.modified
+	swapSeq++
+	seq, path, d := swapSeq, m.swapPath, m.document
+	done := make(chan error, 1)
+	swapWrites.Add(1)
+	go func() {
+		defer swapWrites.Done()
+		swapMu.Lock()
+		defer swapMu.Unlock()
+		if seq < swapWritten[path] {
+			done <- nil
+			return
+		}
+		swapWritten[path] = seq
+		done <- writeSwapFile(path, s, content)
+	}()
+	return func() tea.Msg {
+		return swapWrittenMsg{doc: d, err: <-done}
+	}
+}
+
+// writeSwapFile writes the header s followed by content, if any.
+func writeSwapFile(path string, s swapFile, content *buffer.Buffer) error {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(s); err != nil {
+		return err
+	}
+	if content != nil {
+		data.Grow(content.Len())
+		content.WriteTo(&data)
+	}
+	return writeStateFile(path, data.Bytes())
+}
+
+// swapWritten reports a failed write, which is tried again on the next
+// tick.
+func (m model) swapWritten(msg swapWrittenMsg) (tea.Model, tea.Cmd) {
+	if msg.err != nil {
+		m.err = fmt.Errorf("swap file not written: %w", msg.err)
+		msg.doc.swapChanges = -1
+	}
+	return m, nil
+}
+
+// dropSwap deletes the swap file at path once the writes to it already
+// started are done, and skips those not yet made.
+func dropSwap(path string) {
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	swapWritten[path] = swapSeq + 1
+	os.Remove(path)
+}
+
+// updateSwap rewrites the swap files of the buffers that have changed since
+// theirs were last written.
+func (m model) updateSwap() (tea.Model, tea.Cmd) {
+	cur := m.document
+	cmds := []tea.Cmd{swapTick()}
+	for _, d := range m.docs {
+		if d.swapPath != "" && d.staleSwap == nil &&
+			(d.changes != d.swapChanges || d.modified != d.swapModified) {
+			m.document = d
+			cmds = append(cmds, m.writeSwap())
+		}
+	}
+	m.document = cur
+	return m, tea.Batch(cmds...)
+}
+
+// removeSwap deletes the swap files when hedit exits, after any writes to
+// them still going on.
+func (m model) removeSwap() {
+	swapWrites.Wait()
+	for _, d := range m.docs {
+		if d.swapPath != "" && d.staleSwap == nil {
+			os.Remove(d.swapPath)
+		}
+	}
+}
+
+// updateSwapPrompt handles the question asked on finding a swap file.
+func (m model) updateSwapPrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	s := m.staleSwap
+	switch strings.ToLower(msg.String()) {
+	case "ctrl+x", "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	case "o":
+		if m.mode == "swaplocked" {
+			// Edit without a swap file, leaving the other hedit's alone.
+			m.mode = "edit"
+			m.staleSwap = nil
+			m.nextSwapPrompt()
+			m.status = "Editing without a swap file"
+			return m, m.clearStatusAfter(3 * time.Second)
+		}
+	case "r":
+		if m.mode == "swap" {
+			m.mode = "edit"
+			m.staleSwap = nil
+			m.beginGroup()
+			m.edit(action{kind: "delete", off: 0, text: m.buf.String()})
+			m.edit(action{kind: "insert", off: 0, text: s.Content})
+			m.endGroup()
+			m.setCursor(cursorPos{})
+			m.offsetY, m.offsetX = 0, 0
+			cmd := m.writeSwap()
+			m.nextSwapPrompt()
+			m.status = "Recovered unsaved changes"
+			return m, tea.Batch(cmd, m.clearStatusAfter(3*time.Second))
+		}
+	case "s":
+		if m.mode == "swap" {
+			m.showDiff(m.buf.String(), s.Content, "swap")
+		}
+	case "d":
+		if m.mode == "swap" {
+			m.mode = "edit"
+			m.staleSwap = nil
+			cmd := m.writeSwap()
+			m.nextSwapPrompt()
+			m.status = "Swap file deleted"
+			return m, tea.Batch(cmd, m.clearStatusAfter(3*time.Second))
+		}
+	}
+	return m, nil
+}
+
+// swapPrompt is the question asked on finding a swap file.
+func (m model) swapPrompt() string {
+	s := m.staleSwap
+	if m.mode == "swaplocked" {
+		return fmt.Sprintf("Being edited by hedit (PID %d on %s). (O)pen anyway ^X Exit", s.PID, s.Host)
+	}
+	return fmt.Sprintf("Unsaved changes from %s found. (R)ecover (S)how diff (D)elete ^X Exit",
+		s.Time.Format("Jan 2 15:04"))
+}
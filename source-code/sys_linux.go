@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyAttrs gives f, which is about to replace the file at path, that
+// file's owner and extended attributes. Only root can give a file to
+// another user, so this is done as far as permissions allow and failures
+// are ignored.
+func copyAttrs(f *os.File, info os.FileInfo, path string) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if f.Chown(int(st.Uid), int(st.Gid)) != nil {
+			f.Chown(-1, int(st.Gid))
+		}
+	}
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return
+	}
+	names := make([]byte, size)
+	size, err = unix.Listxattr(path, names)
+	if err != nil {
+		return
+	}
+	fd := int(f.Fd())
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		n, err = unix.Getxattr(path, string(name), value)
+		if err != nil {
+			continue
+		}
+		unix.Fsetxattr(fd, string(name), value[:n], 0)
+	}
+}
+
+// processAlive reports whether a process with the given id is running.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// watchFile reports on the returned channel whenever the file at path may
+// have been changed. The directory is watched rather than the file, so that
+// files replaced by renaming, as editors and git do, are still noticed.
+// Calling stop ends the watch and closes the channel.
+func watchFile(path string) (_ <-chan struct{}, stop func(), _ error) {
+	target, err := resolveLinks(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, base := filepath.Split(target)
+	if dir == "" {
+		dir = "."
+	}
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM)
+	wd, err := unix.InotifyAddWatch(fd, dir, mask)
+	if err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+	// Removing the watch wakes the reader with IN_IGNORED. The lock keeps
+	// stop away from the descriptor once the reader has closed it.
+	var mu sync.Mutex
+	done := false
+	stop = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			unix.InotifyRmWatch(fd, uint32(wd))
+		}
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+			done = true
+			unix.Close(fd)
+		}()
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := unix.Read(fd, buf)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				return
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+				if ev.Mask&unix.IN_IGNORED != 0 {
+					return // stopped, or the directory is gone
+				}
+				if string(bytes.TrimRight(name, "\x00")) == base {
+					select {
+					case ch <- struct{}{}:
+					default: // a change is already pending
+					}
+				}
+			}
+		}
+	}()
+	return ch, stop, nil
+}
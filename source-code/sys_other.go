@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// copyAttrs does nothing here: owners and extended attributes are only
+// carried over on Linux.
+func copyAttrs(f *os.File, info os.FileInfo, path string) {}
+
+// processAlive cannot tell here, so it assumes the process has gone and
+// lets the user decide what to do with its swap file.
+func processAlive(pid int) bool {
+	return false
+}
+
+func watchFile(path string) (_ <-chan struct{}, stop func(), _ error) {
+	return nil, nil, errors.New("watching files is only supported on Linux")
+}
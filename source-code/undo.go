@@ -0,0 +1,247 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// undoPause is how long typing may pause before the next keystroke starts
+// a new undo step.
+const undoPause = time.Second
+
+type action struct {
+	kind  string // "insert", "delete", "group"
+	off   int    // byte offset into the buffer
+	text  string
+	group []action // for "group", applied in order
+	// The cursor before and after the action, restored by undo and redo.
+	before, after cursorPos
+	time          time.Time // when the action was last extended
+}
+
+type cursorPos struct {
+	y, x int // line and byte index
+}
+
+// undoNode is a state of the buffer in the undo tree. Every node but the
+// root is reached from its parent by applying its action; editing after an
+// undo starts a new branch rather than discarding the old one.
+type undoNode struct {
+	action   action
+	parent   *undoNode
+	children []*undoNode // in the order they were made
+	redo     int         // index of the child that redo goes to
+	seq      int         // position in undoTree.nodes
+}
+
+type undoTree struct {
+	nodes   []*undoNode // in the order they were made; nodes[0] is the root
+	current *undoNode   // the state the buffer is in
+}
+
+func newUndoTree() *undoTree {
+	root := &undoNode{action: action{time: time.Now()}}
+	return &undoTree{nodes: []*undoNode{root}, current: root}
+}
+
+// add makes a the latest change from the current state and moves to it.
+func (t *undoTree) add(a action) {
+	cur := t.current
+	n := &undoNode{action: a, parent: cur, seq: len(t.nodes)}
+	cur.children = append(cur.children, n)
+	cur.redo = len(cur.children) - 1
+	t.nodes = append(t.nodes, n)
+	t.current = n
+}
+
+// drop removes the current node, which must be the last one made.
+func (t *undoTree) drop() {
+	cur := t.current
+	parent := cur.parent
+	parent.children = parent.children[:len(parent.children)-1]
+	parent.redo = max(0, len(parent.children)-1)
+	t.nodes = t.nodes[:cur.seq]
+	t.current = parent
+}
+
+func (m *model) pushUndo(a action) {
+	cur := m.history.current
+	if m.groupDepth > 0 {
+		cur.action.group = append(cur.action.group, a)
+		return
+	}
+	// Only a change with nothing redone on top of it can be extended.
+	if cur.parent != nil && len(cur.children) == 0 && !m.undoBreak && coalesce(&cur.action, a) {
+		return
+	}
+	m.undoBreak = false
+	m.history.add(a)
+}
+
+// coalesce merges typed text, or a single deleted character, into the last
+// undo step, so that undo takes back a word at a time. Text typed at once,
+// as an input method commits it, is merged like a character. It reports
+// whether a was merged.
+func coalesce(top *action, a action) bool {
+	if top.kind != a.kind || a.kind == "group" || top.after != a.before ||
+		a.time.Sub(top.time) > undoPause || a.text == "" || strings.Contains(a.text, "\n") ||
+		(a.kind == "delete" && utf8.RuneCountInString(a.text) != 1) {
+		return false
+	}
+	switch {
+	case a.kind == "insert" && a.off == top.off+len(top.text):
+		if startsWord(top.text, a.text) {
+			return false
+		}
+		top.text += a.text
+	case a.kind == "delete" && a.off == top.off: // Delete
+		if startsWord(top.text, a.text) {
+			return false
+		}
+		top.text += a.text
+	case a.kind == "delete" && a.off+len(a.text) == top.off: // Backspace
+		if startsWord(a.text, top.text) {
+			return false
+		}
+		top.off = a.off
+		top.text = a.text + top.text
+	default:
+		return false
+	}
+	top.after = a.after
+	top.time = a.time
+	return true
+}
+
+// startsWord reports whether next begins a new word after prev, which is
+// where a run of typing is split into undo steps. Whitespace stays with the
+// word before it.
+func startsWord(prev, next string) bool {
+	last, _ := utf8.DecodeLastRuneInString(prev)
+	first, _ := utf8.DecodeRuneInString(next)
+	return unicode.IsSpace(last) && !unicode.IsSpace(first)
+}
+
+// breakUndo makes the next edit start a new undo step, for example because
+// the cursor has moved.
+func (m *model) breakUndo() {
+	m.undoBreak = true
+}
+
+// beginGroup starts a transaction: the edits up to the matching endGroup
+// undo and redo as a single step. Transactions may nest.
+func (m *model) beginGroup() {
+	if m.groupDepth == 0 {
+		m.pushUndo(action{kind: "group", before: m.cursor(), time: time.Now()})
+	}
+	m.groupDepth++
+}
+
+func (m *model) endGroup() {
+	m.groupDepth--
+	if m.groupDepth > 0 {
+		return
+	}
+	cur := m.history.current
+	if len(cur.action.group) == 0 {
+		m.history.drop()
+		return
+	}
+	cur.action.after = m.cursor()
+}
+
+// setUndoCursor records the cursor as where redoing the last action leaves
+// it, for edits that move the cursor somewhere of their own choosing.
+func (m *model) setUndoCursor() {
+	if cur := m.history.current; cur.parent != nil && m.groupDepth == 0 {
+		cur.action.after = m.cursor()
+	}
+}
+
+func inverse(a action) action {
+	switch a.kind {
+	case "insert":
+		return action{kind: "delete", off: a.off, text: a.text}
+	case "delete":
+		return action{kind: "insert", off: a.off, text: a.text}
+	case "group":
+		inv := action{kind: "group", group: make([]action, len(a.group))}
+		for i, child := range a.group {
+			inv.group[len(a.group)-1-i] = inverse(child)
+		}
+		return inv
+	}
+	return action{}
+}
+
+// edit applies a and records it in the undo tree.
+func (m *model) edit(a action) {
+	if m.readOnly() {
+		return
+	}
+	a.before = m.cursor()
+	m.applyAction(a)
+	a.after = m.cursor()
+	a.time = time.Now()
+	m.pushUndo(a)
+}
+
+// undo goes back to the parent of the current state.
+func (m *model) undo() {
+	if m.readOnly() {
+		return
+	}
+	n := m.history.current
+	if n.parent == nil {
+		return
+	}
+	m.applyAction(inverse(n.action))
+	m.setCursor(n.action.before)
+	m.history.current = n.parent
+	n.parent.redo = slices.Index(n.parent.children, n)
+	m.breakUndo()
+}
+
+// redo goes forward to the child of the current state that was last undone,
+// or else the newest one.
+func (m *model) redo() {
+	if m.readOnly() {
+		return
+	}
+	cur := m.history.current
+	if len(cur.children) == 0 {
+		return
+	}
+	n := cur.children[cur.redo]
+	m.applyAction(n.action)
+	m.setCursor(n.action.after)
+	m.history.current = n
+	m.breakUndo()
+}
+
+// restore undoes and redoes changes until the buffer is in the state of
+// node n, which may be on another branch.
+func (m *model) restore(n *undoNode) {
+	if m.readOnly() {
+		return
+	}
+	path := map[*undoNode]bool{}
+	for p := n; p != nil; p = p.parent {
+		path[p] = true
+	}
+	for !path[m.history.current] {
+		m.undo()
+	}
+	var down []*undoNode
+	for p := n; p != m.history.current; p = p.parent {
+		down = append(down, p)
+	}
+	for i := len(down) - 1; i >= 0; i-- {
+		p := down[i]
+		p.parent.redo = slices.Index(p.parent.children, p)
+		m.redo()
+	}
+}
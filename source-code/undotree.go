@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+var errBadTravel = errors.New("invalid time or number of changes")
+
+// undoRow is a node of the undo tree as listed by the browser. Each branch
+// after the first is indented one level further than the node it leaves.
+type undoRow struct {
+	node  *undoNode
+	level int
+}
+
+// rows lists the tree depth first, each branch in full before the next.
+func (t *undoTree) rows() []undoRow {
+	var rows []undoRow
+	stack := []undoRow{{t.nodes[0], 0}}
+	for len(stack) > 0 {
+		r := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		rows = append(rows, r)
+		for i := len(r.node.children) - 1; i >= 0; i-- {
+			level := r.level
+			if i > 0 {
+				level++
+			}
+			stack = append(stack, undoRow{r.node.children[i], level})
+		}
+	}
+	return rows
+}
+
+// at returns the node the buffer was in at time t, as near as can be told:
+// the latest change made by then, or the root.
+func (t *undoTree) at(when time.Time) *undoNode {
+	found := t.nodes[0]
+	for _, n := range t.nodes[1:] {
+		if !n.action.time.After(when) && !n.action.time.Before(found.action.time) {
+			found = n
+		}
+	}
+	return found
+}
+
+// travel moves through the changes in the order they were made, whatever
+// branch they are on. spec is either a duration such as "5m" or a number of
+// changes, and goes back in time unless it starts with "+".
+func (m *model) travel(spec string) error {
+	spec = strings.TrimSpace(spec)
+	forward := strings.HasPrefix(spec, "+")
+	spec = strings.TrimLeft(spec, "+-")
+	t := m.history
+	var target *undoNode
+	if n, err := strconv.Atoi(spec); err == nil {
+		if !forward {
+			n = -n
+		}
+		target = t.nodes[max(0, min(t.current.seq+n, len(t.nodes)-1))]
+	} else {
+		d, err := time.ParseDuration(spec)
+		if err != nil || d < 0 {
+			return errBadTravel
+		}
+		if !forward {
+			d = -d
+		}
+		target = t.at(t.current.action.time.Add(d))
+	}
+	m.restore(target)
+	return nil
+}
+
+// describe tells which change the buffer is at, for the status line.
+func (n *undoNode) describe() string {
+	if n.parent == nil {
+		return "At original text"
+	}
+	return fmt.Sprintf("At change %d, %s", n.seq, ago(n.action.time))
+}
+
+// summary describes the change made by a in a few words.
+func (a action) summary() string {
+	if a.kind == "group" {
+		if len(a.group) == 1 {
+			return a.group[0].summary()
+		}
+		return fmt.Sprintf("%d changes", len(a.group))
+	}
+	text, runes := a.text, 0
+	for i := range text {
+		if runes == 24 {
+			text = text[:i] + "…"
+			break
+		}
+		runes++
+	}
+	return a.kind + " " + strconv.Quote(text)
+}
+
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return t.Format("Jan 2 15:04")
+}
+
+// startUndoTree opens the browser with the current state selected.
+func (m *model) startUndoTree() {
+	m.mode = "undotree"
+	m.undoRows = m.history.rows()
+	for i, r := range m.undoRows {
+		if r.node == m.history.current {
+			m.undoSel = i
+		}
+	}
+}
+
+func (m model) updateUndoTree(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c", "q":
+		m.mode = "edit"
+	case "up", "k":
+		m.undoSel = max(0, m.undoSel-1)
+	case "down", "j":
+		m.undoSel = min(m.undoSel+1, len(m.undoRows)-1)
+	case "pgup":
+		m.undoSel = max(0, m.undoSel-m.screenHeight)
+	case "pgdown":
+		m.undoSel = min(m.undoSel+m.screenHeight, len(m.undoRows)-1)
+	case "home":
+		m.undoSel = 0
+	case "end":
+		m.undoSel = len(m.undoRows) - 1
+	case "enter":
+		m.mode = "edit"
+		n := m.undoRows[m.undoSel].node
+		m.restore(n)
+		m.adjustScroll()
+		if m.hex {
+			m.hexSynced()
+		}
+		m.status = n.describe()
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	return m, nil
+}
+
+// renderUndoTree draws the browser in place of the text.
+func (m model) renderUndoTree() string {
+	top := max(0, min(m.undoSel-m.screenHeight/2, len(m.undoRows)-m.screenHeight))
+	lines := []string{}
+	for i := top; i < min(top+m.screenHeight, len(m.undoRows)); i++ {
+		r := m.undoRows[i]
+		marker := "  "
+		if r.node == m.history.current {
+			marker = "* "
+		}
+		what := "original text"
+		if r.node.parent != nil {
+			what = fmt.Sprintf("%d: %s", r.node.seq, r.node.action.summary())
+		}
+		line := marker + strings.Repeat("  ", r.level) + what
+		when := ago(r.node.action.time)
+		if pad := m.screenWidth - utf8.RuneCountInString(line) - len(when); pad > 0 {
+			line += strings.Repeat(" ", pad) + when
+		}
+		if i == m.undoSel {
+			line = cursorStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < m.screenHeight {
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m model) updateTravel(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.mode = "edit"
+		return m, nil
+	case "enter":
+		m.mode = "edit"
+		err := m.travel(m.travelInput.Value())
+		m.travelInput.SetValue("")
+		if err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
+		m.adjustScroll()
+		if m.hex {
+			m.hexSynced()
+		}
+		m.status = m.history.current.describe()
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	var cmd tea.Cmd
+	m.travelInput, cmd = m.travelInput.Update(msg)
+	return m, cmd
+}
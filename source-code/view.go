@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// With -v the files are only looked at: everything that would change a
+// buffer or write a file is refused. Run as hview, hedit is also a pager
+// that keeps the keys of less.
+
+var errViewMode = errors.New("cannot change the file in view mode")
+
+// readOnly reports whether the buffer may not be changed, saying so if so.
+func (m *model) readOnly() bool {
+	if m.viewOnly {
+		m.err = errViewMode
+		return true
+	}
+	return false
+}
+
+// updatePager handles the keys of the pager. The cursor stays on the
+// screen, so that searches start from what is on it and it can show what
+// they found.
+func (m model) updatePager(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	page := max(1, m.height-1)
+	switch msg.String() {
+	case "q", "Q", "ctrl+x":
+		return m.exit()
+	case " ", "f", "pgdown", "ctrl+v":
+		m.scroll(page)
+	case "b", "pgup", "ctrl+b":
+		m.scroll(-page)
+	case "d":
+		m.scroll(page / 2)
+	case "u":
+		m.scroll(-page / 2)
+	case "j", "down", "enter":
+		m.scroll(1)
+	case "k", "up":
+		m.scroll(-1)
+	case "g", "<", "home":
+		m.scroll(-m.buf.Len() - 1)
+	case "G", ">", "end":
+		m.scroll(m.buf.Len() + 1)
+	case "/", "ctrl+w":
+		m.mode = "search"
+		m.startSearch()
+	case "n":
+		return m.findNext(false)
+	case "N":
+		return m.findNext(true)
+	default:
+		switch {
+		case key.Matches(msg, nextBufKey):
+			return m.cycleBuffer(1)
+		case key.Matches(msg, prevBufKey):
+			return m.cycleBuffer(-1)
+		case key.Matches(msg, bufListKey):
+			m.startBufferList()
+		}
+	}
+	return m, nil
+}
+
+// scroll moves the text n lines up the screen, as far as it goes, and
+// brings the cursor along if it would be left off the screen.
+func (m *model) scroll(n int) {
+	if m.hex {
+		m.hexTop = max(0, min(m.hexTop+n, m.buf.Len()/bytesPerRow-m.height+1))
+		if row := m.hexCursor / bytesPerRow; row < m.hexTop || row >= m.hexTop+m.height {
+			m.hexMove(m.hexTop * bytesPerRow)
+		}
+		return
+	}
+	m.offsetY = max(0, min(m.offsetY+n, m.buf.LineCount()-m.height))
+	if m.cursorY < m.offsetY || m.cursorY >= m.offsetY+m.height {
+		m.setCursor(cursorPos{m.offsetY, 0})
+	}
+}
+
+// pagerFooter is the help shown by the pager.
+func (m model) pagerFooter() string {
+	line1 := "SPACE Page Down  b Page Up  d Half Down  u Half Up  j/k Line  g/G Top/Bottom"
+	line2 := "q Quit           / Search   n Next       N Previous M-. Next Buffer"
+	return footerStyle.Render(line1 + "\n" + line2)
+}
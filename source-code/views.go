@@ -0,0 +1,264 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// The screen between the title bar and the help lines can be split into
+// views, side by side or one above the other, each showing a buffer. The
+// view with the focus keeps its cursor and scroll position in the document,
+// where all the editing code expects them, and m.width and m.height are its
+// size; the other views keep theirs in their view.
+
+var (
+	splitKey  = key.NewBinding(key.WithKeys("alt+-"))
+	vsplitKey = key.NewBinding(key.WithKeys("alt+\\"))
+	focusKey  = key.NewBinding(key.WithKeys("alt+o"))
+	closeKey  = key.NewBinding(key.WithKeys("alt+0"))
+)
+
+var splitStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#626262"))
+
+// viewState is where a view is in its document. The cursor is kept as an
+// offset so that it can follow edits made through other views.
+type viewState struct {
+	cursor           int
+	offsetY, offsetX int
+	hexCursor        int
+	hexNibble        int
+	hexTop           int
+	changes          int // of the document when the state was saved
+}
+
+type view struct {
+	doc           *document
+	state         viewState // while another view has the focus
+	width, height int
+}
+
+// pane is a node of the layout: a view, or two panes split between them.
+type pane struct {
+	view     *view
+	vertical bool // side by side rather than one above the other
+	a, b     *pane
+	parent   *pane
+}
+
+func (m *model) viewState() viewState {
+	return viewState{
+		cursor:    m.cursorOffset(),
+		offsetY:   m.offsetY,
+		offsetX:   m.offsetX,
+		hexCursor: m.hexCursor,
+		hexNibble: m.hexNibble,
+		hexTop:    m.hexTop,
+		changes:   m.changes,
+	}
+}
+
+// setViewState moves to s, which may be out of date if the buffer has
+// changed since. A byte typed halfway is then given up, as it may have
+// changed or gone.
+func (m *model) setViewState(s viewState) {
+	y, x := m.buf.Position(s.cursor)
+	m.setCursor(cursorPos{y, x})
+	m.offsetY, m.offsetX = s.offsetY, s.offsetX
+	m.hexCursor = max(0, min(s.hexCursor, m.buf.Len()))
+	m.hexNibble, m.hexTop = s.hexNibble, s.hexTop
+	if s.changes != m.changes || m.hexCursor == m.buf.Len() {
+		m.hexNibble, m.hexStep = 0, nil
+	}
+	m.adjustScroll()
+	m.hexScroll()
+}
+
+// shiftOffset moves an offset past an edit made elsewhere.
+func shiftOffset(off int, a action) int {
+	switch {
+	case off <= a.off:
+		return off
+	case a.kind == "insert":
+		return off + len(a.text)
+	}
+	return max(a.off, off-len(a.text))
+}
+
+// shiftViews keeps the other views of the buffer where they were in the
+// text when a is applied to it.
+func (m *model) shiftViews(a action) {
+	for _, p := range m.panes() {
+		if p != m.focus && p.view.doc == m.document {
+			s := &p.view.state
+			s.cursor = shiftOffset(s.cursor, a)
+			s.hexCursor = shiftOffset(s.hexCursor, a)
+		}
+	}
+}
+
+// panes lists the views of the layout from top left to bottom right.
+func (m *model) panes() []*pane {
+	var leaves []*pane
+	var walk func(p *pane)
+	walk = func(p *pane) {
+		if p.view != nil {
+			leaves = append(leaves, p)
+			return
+		}
+		walk(p.a)
+		walk(p.b)
+	}
+	walk(m.layout)
+	return leaves
+}
+
+// layoutViews shares out the screen between the views.
+func (m *model) layoutViews() {
+	var layout func(p *pane, w, h int)
+	layout = func(p *pane, w, h int) {
+		switch {
+		case p.view != nil:
+			p.view.width, p.view.height = w, h
+		case p.vertical:
+			layout(p.a, (w-1)/2, h)
+			layout(p.b, w-1-(w-1)/2, h)
+		default:
+			layout(p.a, w, (h-1)/2)
+			layout(p.b, w, h-1-(h-1)/2)
+		}
+	}
+	layout(m.layout, m.screenWidth, m.screenHeight)
+	m.width, m.height = m.focus.view.width, m.focus.view.height
+}
+
+// blur saves the position of the view with the focus in the view.
+func (m *model) blur() {
+	m.focus.view.doc = m.document
+	m.focus.view.state = m.viewState()
+}
+
+// focusPane gives the focus to p.
+func (m *model) focusPane(p *pane) {
+	m.focus = p
+	m.document = p.view.doc
+	m.width, m.height = p.view.width, p.view.height
+	m.setViewState(p.view.state)
+}
+
+// split divides the view with the focus in two, both showing its buffer,
+// and moves to the new one.
+func (m *model) split(vertical bool) {
+	m.blur()
+	old := m.focus
+	a := &pane{view: old.view, parent: old}
+	b := &pane{view: &view{doc: old.view.doc, state: old.view.state}, parent: old}
+	old.view, old.vertical, old.a, old.b = nil, vertical, a, b
+	m.focus = b
+	m.layoutViews()
+	m.focusPane(b)
+}
+
+// closeView removes the view with the focus, giving its space to the view
+// or views it was split from.
+func (m model) closeView() (tea.Model, tea.Cmd) {
+	p := m.focus
+	if p.parent == nil {
+		m.status = "Cannot close the only view"
+		return m, m.clearStatusAfter(3 * time.Second)
+	}
+	sibling := p.parent.a
+	if sibling == p {
+		sibling = p.parent.b
+	}
+	parent := p.parent
+	*parent = pane{view: sibling.view, vertical: sibling.vertical, a: sibling.a, b: sibling.b, parent: parent.parent}
+	if parent.view == nil {
+		parent.a.parent, parent.b.parent = parent, parent
+	}
+	m.focus = parent
+	for m.focus.view == nil {
+		m.focus = m.focus.a
+	}
+	m.layoutViews()
+	m.focusPane(m.focus)
+	return m, nil
+}
+
+// cycleFocus moves the focus to the next view.
+func (m model) cycleFocus() (tea.Model, tea.Cmd) {
+	panes := m.panes()
+	if len(panes) == 1 {
+		return m, nil
+	}
+	m.blur()
+	for i, p := range panes {
+		if p == m.focus {
+			m.focusPane(panes[(i+1)%len(panes)])
+			break
+		}
+	}
+	return m, nil
+}
+
+// renderLayout draws the views and the lines between them.
+func (m model) renderLayout() string {
+	var render func(p *pane) string
+	render = func(p *pane) string {
+		if p.view != nil {
+			return m.renderView(p)
+		}
+		a, b := render(p.a), render(p.b)
+		if p.vertical {
+			sep := strings.TrimSuffix(strings.Repeat("│\n", p.a.height()), "\n")
+			return lipgloss.JoinHorizontal(lipgloss.Top, a, splitStyle.Render(sep), b)
+		}
+		return lipgloss.JoinVertical(lipgloss.Left, a, splitStyle.Render(strings.Repeat("─", p.width())), b)
+	}
+	return render(m.layout)
+}
+
+// renderView draws one view. Views without the focus are drawn from a copy
+// of their document put at their own position, without a cursor.
+func (m model) renderView(p *pane) string {
+	v := p.view
+	if p != m.focus {
+		d := *v.doc
+		m.document = &d
+		m.width, m.height = v.width, v.height
+		m.setViewState(v.state)
+		m.markSet = false
+		m.unfocused = true
+	}
+	var body string
+	if m.hex {
+		body = m.renderHex()
+	} else {
+		body = m.renderBody()
+	}
+	body = lipgloss.NewStyle().MaxWidth(v.width).Render(body)
+	return lipgloss.NewStyle().Width(v.width).Height(v.height).MaxHeight(v.height).Render(body)
+}
+
+func (p *pane) width() int {
+	if p.view != nil {
+		return p.view.width
+	}
+	if p.vertical {
+		return p.a.width() + 1 + p.b.width()
+	}
+	return p.a.width()
+}
+
+func (p *pane) height() int {
+	if p.view != nil {
+		return p.view.height
+	}
+	if p.vertical {
+		return p.a.height()
+	}
+	return p.a.height() + 1 + p.b.height()
+}